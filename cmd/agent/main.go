@@ -2,11 +2,65 @@ package main
 
 import (
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/terlyne/go-calculator/pkg/agent"
+	"github.com/terlyne/go-calculator/pkg/calculator"
 )
 
 func main() {
+	// Функции, специфичные для развертывания
+	if path := os.Getenv("FUNCTIONS_PATH"); path != "" {
+		if err := calculator.DefaultRegistry.LoadDefinitions(path); err != nil {
+			log.Fatalf("Ошибка загрузки функций: %v", err)
+		}
+	}
+
+	if url := os.Getenv("ORCHESTRATOR_URL"); url != "" {
+		agent.OrchestratorURL = url
+	}
+	if power := os.Getenv("COMPUTING_POWER"); power != "" {
+		n, err := strconv.Atoi(power)
+		if err != nil || n < 1 {
+			log.Fatalf("Неверное значение COMPUTING_POWER: %s", power)
+		}
+		agent.Concurrency = n
+	}
+	// Специализированный агент берет только перечисленные операции, например "+,-,*,/"
+	if operations := os.Getenv("AGENT_OPERATIONS"); operations != "" {
+		for _, op := range strings.Split(operations, ",") {
+			if op = strings.TrimSpace(op); op != "" {
+				agent.Operations = append(agent.Operations, op)
+			}
+		}
+	}
+	// Режимы, в которых агент выполняет операции, например "float64,prob"
+	if modes := os.Getenv("AGENT_MODES"); modes != "" {
+		agent.Modes = nil
+		for _, mode := range strings.Split(modes, ",") {
+			if mode = strings.TrimSpace(mode); mode != "" {
+				agent.Modes = append(agent.Modes, mode)
+			}
+		}
+	}
+	if wait := os.Getenv("POLL_WAIT"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение POLL_WAIT: %s", wait)
+		}
+		agent.PollWait = d
+	}
+	if interval := os.Getenv("HEARTBEAT_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение HEARTBEAT_INTERVAL: %s", interval)
+		}
+		agent.HeartbeatInterval = d
+	}
+
 	log.Println("Старт агента...")
 	agent.StartAgent()
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -16,7 +19,9 @@ import (
 	"github.com/terlyne/go-calculator/internal/auth"
 	"github.com/terlyne/go-calculator/internal/database"
 	"github.com/terlyne/go-calculator/internal/models"
+	"github.com/terlyne/go-calculator/internal/rates"
 	"github.com/terlyne/go-calculator/pkg/calculator"
+	"github.com/terlyne/go-calculator/pkg/plot"
 	"github.com/gorilla/mux"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -26,8 +31,12 @@ import (
 // Структура сервера, реализующая gRPC интерфейс
 type server struct {
 	pb.UnimplementedCalculatorServer
-	db   *database.Database
-	auth *auth.Auth
+	db      *database.Database
+	auth    *auth.Auth
+	rates   *rates.Watcher
+	decimal calculator.DecimalOptions
+	// cache — результаты чистых выражений; nil отключает кэш
+	cache *calculator.Cache
 }
 
 // Регистрация нового пользователя
@@ -81,10 +90,12 @@ func (s *server) Calculate(ctx context.Context, req *pb.CalculateRequest) (*pb.C
 	}
 
 	expr := &models.Expression{
-		UserID:     claims.UserID,
-		Expression: req.Expression,
-		Result:     result,
-		Status:     "completed",
+		UserID:      claims.UserID,
+		Expression:  req.Expression,
+		Result:      result,
+		ResultValue: calculator.Number(result).String(),
+		ResultType:  calculator.KindNumber.String(),
+		Status:      "completed",
 	}
 
 	if err := s.db.SaveExpression(expr); err != nil {
@@ -101,7 +112,8 @@ func (s *server) GetExpressions(ctx context.Context, req *pb.GetExpressionsReque
 		return nil, status.Error(codes.Unauthenticated, "неверный токен")
 	}
 
-	expressions, err := s.db.GetUserExpressions(claims.UserID)
+	// gRPC API не поддерживает страницы и возвращает всю историю
+	expressions, _, err := s.db.GetUserExpressions(claims.UserID, database.ExpressionQuery{Sort: database.SortCreatedAt, Desc: true})
 	if err != nil {
 		return nil, status.Error(codes.Internal, "ошибка получения выражений")
 	}
@@ -143,10 +155,53 @@ func main() {
 	}
 	auth := auth.NewAuth(secretKey)
 
+	// Функции, специфичные для развертывания
+	if path := os.Getenv("FUNCTIONS_PATH"); path != "" {
+		if err := calculator.DefaultRegistry.LoadDefinitions(path); err != nil {
+			log.Fatalf("Ошибка загрузки функций: %v", err)
+		}
+	}
+
+	// Точность десятичного режима по умолчанию
+	decimal := calculator.DecimalOptions{Scale: 2, Rounding: calculator.RoundHalfEven}
+	if scale := os.Getenv("DECIMAL_SCALE"); scale != "" {
+		if decimal.Scale, err = strconv.Atoi(scale); err != nil || decimal.Scale < 0 {
+			log.Fatalf("Неверное значение DECIMAL_SCALE: %s", scale)
+		}
+	}
+	if decimal.Rounding, err = calculator.ParseRounding(os.Getenv("DECIMAL_ROUNDING")); err != nil {
+		log.Fatalf("Неверное значение DECIMAL_ROUNDING: %v", err)
+	}
+
+	// Кэш результатов чистых выражений; CACHE_SIZE=0 отключает его
+	cacheSize, cacheTTL := 10000, time.Hour
+	if size := os.Getenv("CACHE_SIZE"); size != "" {
+		if cacheSize, err = strconv.Atoi(size); err != nil || cacheSize < 0 {
+			log.Fatalf("Неверное значение CACHE_SIZE: %s", size)
+		}
+	}
+	if ttl := os.Getenv("CACHE_TTL"); ttl != "" {
+		if cacheTTL, err = time.ParseDuration(ttl); err != nil || cacheTTL <= 0 {
+			log.Fatalf("Неверное значение CACHE_TTL: %s", ttl)
+		}
+	}
+
 	// Создание экземпляра сервера
 	server := &server{
-		db:   db,
-		auth: auth,
+		db:      db,
+		auth:    auth,
+		decimal: decimal,
+		cache:   calculator.NewCache(cacheSize, cacheTTL),
+	}
+
+	// Курсы валют для денежных выражений
+	if ratesPath := os.Getenv("RATES_PATH"); ratesPath != "" {
+		watcher, err := rates.NewWatcher(ratesPath, 10*time.Second)
+		if err != nil {
+			log.Fatalf("Ошибка загрузки курсов валют: %v", err)
+		}
+		defer watcher.Close()
+		server.rates = watcher
 	}
 
 	// Запуск gRPC сервера
@@ -169,6 +224,9 @@ func main() {
 	go func() {
 		r := mux.NewRouter()
 		r.HandleFunc("/api/v1/calculate", server.calculateHandler).Methods("POST")
+		r.HandleFunc("/api/v1/expressions", server.expressionsHandler).Methods("GET")
+		r.HandleFunc("/api/v1/table", server.tableHandler).Methods("POST")
+		r.HandleFunc("/api/v1/cache", server.cacheHandler).Methods("GET")
 
 		log.Println("Запуск HTTP сервера на порту :8080")
 		if err := http.ListenAndServe(":8080", r); err != nil {
@@ -184,20 +242,20 @@ func main() {
 	log.Println("Завершение работы серверов...")
 }
 
-// HTTP handler for calculation
-func (s *server) calculateHandler(w http.ResponseWriter, r *http.Request) {
+// authenticate извлекает и проверяет Bearer токен из заголовка Authorization
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
 	// Получаем токен из заголовка Authorization
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		http.Error(w, `{"error": "Authorization header is required"}`, http.StatusUnauthorized)
-		return
+		return nil, false
 	}
 
 	// Проверяем формат токена (Bearer token)
 	tokenParts := strings.Split(authHeader, " ")
 	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
 		http.Error(w, `{"error": "Invalid authorization header format"}`, http.StatusUnauthorized)
-		return
+		return nil, false
 	}
 
 	token := tokenParts[1]
@@ -206,28 +264,129 @@ func (s *server) calculateHandler(w http.ResponseWriter, r *http.Request) {
 	claims, err := s.auth.ValidateToken(token)
 	if err != nil {
 		http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
-		return
+		return nil, false
 	}
+	return claims, true
+}
 
-	var req struct {
-		Expression string `json:"expression"`
+// errorResponse — тело ответа с ошибкой; Code задан для ошибок калькулятора.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// writeError отвечает JSON с текстом ошибки err и статусом status. Текст
+// кодируется, а не подставляется в строку: сообщения калькулятора содержат
+// кавычки.
+func writeError(w http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	var calcErr *calculator.Error
+	if errors.As(err, &calcErr) {
+		resp.Code = calcErr.Code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// calcRequest — параметры вычисления в HTTP API.
+type calcRequest struct {
+	Expression string             `json:"expression"`
+	Timezone   string             `json:"timezone"`
+	Decimal    bool               `json:"decimal"`
+	Scale      *int               `json:"scale"`
+	Rounding   string             `json:"rounding"`
+	Variables  map[string]float64 `json:"variables"`
+	Strict     bool               `json:"strict"`
+	Implicit   string             `json:"implicit"`
+	Seed       *int64             `json:"seed"`
+}
+
+// options собирает параметры калькулятора из запроса. Вторым значением
+// возвращается текст ошибки для клиента.
+func (s *server) options(req calcRequest) (calculator.Options, string) {
+	// seed генерируется всегда, чтобы любой результат можно было воспроизвести
+	seed := rand.Int63()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	opts := calculator.Options{Strict: req.Strict, Seed: &seed}
+	if s.rates != nil {
+		opts.Rates = s.rates.Rates()
+	}
+	if req.Decimal {
+		decimal := s.decimal
+		if req.Scale != nil {
+			if *req.Scale < 0 {
+				return opts, "Invalid scale"
+			}
+			decimal.Scale = *req.Scale
+		}
+		if req.Rounding != "" {
+			rounding, err := calculator.ParseRounding(req.Rounding)
+			if err != nil {
+				return opts, "Invalid rounding"
+			}
+			decimal.Rounding = rounding
+		}
+		opts.Decimal = &decimal
+	}
+	if req.Timezone != "" {
+		loc, err := time.LoadLocation(req.Timezone)
+		if err != nil {
+			return opts, "Unknown timezone"
+		}
+		opts.Location = loc
+	}
+	implicit, err := calculator.ParseImplicit(req.Implicit)
+	if err != nil {
+		return opts, "Invalid implicit multiplication convention"
+	}
+	opts.Implicit = implicit
+	if len(req.Variables) > 0 {
+		opts.Vars = make(map[string]calculator.Value, len(req.Variables))
+		for name, value := range req.Variables {
+			opts.Vars[name] = calculator.Number(value)
+		}
+	}
+	return opts, ""
+}
+
+// HTTP handler for calculation
+func (s *server) calculateHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
 	}
+
+	var req calcRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
 		return
 	}
 
-	result, err := calculator.Calc(req.Expression)
+	opts, msg := s.options(req)
+	if msg != "" {
+		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	opts.Cache = s.cache
+	result, err := calculator.Evaluate(req.Expression, opts)
 	if err != nil {
-		http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	num, _ := result.Float()
 	expr := &models.Expression{
-		UserID:     claims.UserID,
-		Expression: req.Expression,
-		Result:     result,
-		Status:     "completed",
+		UserID:      claims.UserID,
+		Expression:  req.Expression,
+		Result:      num,
+		ResultValue: result.String(),
+		ResultType:  result.Kind().String(),
+		Seed:        opts.Seed,
+		Status:      "completed",
 	}
 
 	if err := s.db.SaveExpression(expr); err != nil {
@@ -236,5 +395,106 @@ func (s *server) calculateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]float64{"result": result})
+	response := map[string]interface{}{"result": result, "type": result.Kind().String(), "seed": *opts.Seed}
+	if currency := result.Currency(); currency != "" {
+		response["currency"] = currency
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// HTTP handler for result cache statistics
+func (s *server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cache": s.cache.Stats()})
+}
+
+// HTTP handler for function tables and plots
+func (s *server) tableHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		calcRequest
+		ExpressionID int64   `json:"expression_id"`
+		Variable     string  `json:"variable"`
+		From         float64 `json:"from"`
+		To           float64 `json:"to"`
+		Step         float64 `json:"step"`
+		Format       string  `json:"format"`
+		Width        int     `json:"width"`
+		Height       int     `json:"height"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.ExpressionID != 0 {
+		expr, err := s.db.GetUserExpression(claims.UserID, req.ExpressionID)
+		if err != nil {
+			http.Error(w, `{"error": "Expression not found"}`, http.StatusNotFound)
+			return
+		}
+		req.Expression = expr.Expression
+	}
+	if req.Variable == "" {
+		req.Variable = "x"
+	}
+
+	opts, msg := s.options(req.calcRequest)
+	if msg != "" {
+		http.Error(w, `{"error": "`+msg+`"}`, http.StatusBadRequest)
+		return
+	}
+	points, err := calculator.TableWithOptions(req.Expression, req.Variable, req.From, req.To, req.Step, opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch req.Format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"expression": req.Expression, "variable": req.Variable, "seed": *opts.Seed, "points": points})
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		plot.WriteCSV(w, points)
+	case "svg":
+		if req.Width <= 0 || req.Height <= 0 {
+			req.Width, req.Height = 640, 480
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(plot.SVG(points, req.Width, req.Height))
+	default:
+		http.Error(w, `{"error": "Unknown format"}`, http.StatusBadRequest)
+	}
+}
+
+// HTTP handler for calculation history
+func (s *server) expressionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := database.ParseExpressionQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	expressions, next, err := s.db.GetUserExpressions(claims.UserID, query)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to get expressions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Expressions []*models.Expression `json:"expressions"`
+		NextCursor  string               `json:"next_cursor,omitempty"`
+	}{expressions, next})
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/terlyne/go-calculator/internal/auth"
+	"github.com/terlyne/go-calculator/internal/config"
+	"github.com/terlyne/go-calculator/internal/database"
+	"github.com/terlyne/go-calculator/pkg/calculator"
+	"github.com/terlyne/go-calculator/pkg/orchestrator"
+)
+
+func main() {
+	// Функции, специфичные для развертывания; агенты должны загрузить тот же файл
+	if path := os.Getenv("FUNCTIONS_PATH"); path != "" {
+		if err := calculator.DefaultRegistry.LoadDefinitions(path); err != nil {
+			log.Fatalf("Ошибка загрузки функций: %v", err)
+		}
+	}
+	if addr := os.Getenv("ORCHESTRATOR_ADDR"); addr != "" {
+		orchestrator.Address = addr
+	}
+
+	if timeout := os.Getenv("LEASE_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение LEASE_TIMEOUT: %s", timeout)
+		}
+		orchestrator.LeaseTimeout = d
+	}
+	if timeout := os.Getenv("AGENT_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение AGENT_TIMEOUT: %s", timeout)
+		}
+		orchestrator.AgentTimeout = d
+	}
+	orchestrator.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if window := os.Getenv("IDEMPOTENCY_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение IDEMPOTENCY_WINDOW: %s", window)
+		}
+		orchestrator.IdempotencyWindow = d
+	}
+
+	if size := os.Getenv("MAX_BATCH_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Неверное значение MAX_BATCH_SIZE: %s", size)
+		}
+		orchestrator.MaxBatchSize = n
+	}
+
+	// Кэш результатов подвыражений; CACHE_SIZE=0 отключает его
+	cacheSize, cacheTTL := 10000, time.Hour
+	if size := os.Getenv("CACHE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Неверное значение CACHE_SIZE: %s", size)
+		}
+		cacheSize = n
+	}
+	if ttl := os.Getenv("CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение CACHE_TTL: %s", ttl)
+		}
+		cacheTTL = d
+	}
+	orchestrator.ResultCache = calculator.NewCache(cacheSize, cacheTTL)
+
+	// Имитация времени выполнения операций для нагрузочного тестирования
+	times, err := config.LoadOperationTimes(os.Getenv("OPERATION_TIMES_PATH"))
+	if err != nil {
+		log.Fatalf("Ошибка загрузки времени операций: %v", err)
+	}
+	orchestrator.OperationTimes = times.Durations()
+
+	if policy := os.Getenv("SCHEDULING_POLICY"); policy != "" {
+		p, err := orchestrator.ParsePolicy(policy)
+		if err != nil {
+			log.Fatalf("Неверное значение SCHEDULING_POLICY: %v", err)
+		}
+		orchestrator.SchedulingPolicy = p
+	}
+	if weights := os.Getenv("USER_WEIGHTS"); weights != "" {
+		w, err := orchestrator.ParseWeights(weights)
+		if err != nil {
+			log.Fatalf("Неверное значение USER_WEIGHTS: %v", err)
+		}
+		orchestrator.UserWeights = w
+	}
+	// Режимы операций для маршрутизации задач специализированным агентам
+	if modes := os.Getenv("OPERATION_MODES"); modes != "" {
+		m, err := orchestrator.ParseOperationModes(modes)
+		if err != nil {
+			log.Fatalf("Неверное значение OPERATION_MODES: %v", err)
+		}
+		orchestrator.OperationModes = m
+	}
+	// Вебхуки о завершении выражений
+	orchestrator.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	// Внутренние хосты, которым разрешено получать вебхуки
+	for _, host := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			orchestrator.WebhookAllowedHosts = append(orchestrator.WebhookAllowedHosts, strings.ToLower(host))
+		}
+	}
+	if webhooks := os.Getenv("USER_WEBHOOKS"); webhooks != "" {
+		w, err := orchestrator.ParseWebhooks(webhooks)
+		if err != nil {
+			log.Fatalf("Неверное значение USER_WEBHOOKS: %v", err)
+		}
+		orchestrator.UserWebhooks = w
+	}
+	// С JWT_SECRET_KEY выражения отправляют только пользователи с токеном сервиса
+	if secretKey := os.Getenv("JWT_SECRET_KEY"); secretKey != "" {
+		orchestrator.Auth = auth.NewAuth(secretKey)
+	}
+
+	// Без ORCHESTRATOR_DB состояние хранится в памяти и теряется при перезапуске
+	if path := os.Getenv("ORCHESTRATOR_DB"); path != "" {
+		db, err := database.NewDatabase(path)
+		if err != nil {
+			log.Fatalf("Ошибка открытия базы данных: %v", err)
+		}
+		defer db.Close()
+		if err := orchestrator.Open(orchestrator.NewSQLiteStore(db)); err != nil {
+			log.Fatalf("Ошибка восстановления состояния: %v", err)
+		}
+	}
+
+	log.Printf("Старт оркестратора на %s...", orchestrator.Address)
+	orchestrator.StartServer()
+}
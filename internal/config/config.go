@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -39,3 +40,60 @@ func MustLoad() *Config {
 
 	return &cfg
 }
+
+// OperationTimes задает имитируемое время выполнения операций агентами в
+// миллисекундах. Значения из файла перекрываются переменными окружения.
+type OperationTimes struct {
+	Addition       int `yaml:"addition" env:"TIME_ADDITION_MS"`
+	Subtraction    int `yaml:"subtraction" env:"TIME_SUBTRACTION_MS"`
+	Multiplication int `yaml:"multiplication" env:"TIME_MULTIPLICATIONS_MS"`
+	Division       int `yaml:"division" env:"TIME_DIVISIONS_MS"`
+	// Negation — время унарного минуса, отдельное от вычитания
+	Negation int `yaml:"negation" env:"TIME_NEGATION_MS"`
+	// Operations задает время остальных операторов и функций по имени
+	Operations map[string]int `yaml:"operations"`
+}
+
+// LoadOperationTimes читает время операций из файла path (если он указан) и
+// переменных окружения.
+func LoadOperationTimes(path string) (*OperationTimes, error) {
+	var times OperationTimes
+	var err error
+	if path != "" {
+		err = cleanenv.ReadConfig(path, &times)
+	} else {
+		err = cleanenv.ReadEnv(&times)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, ms := range times.all() {
+		if ms < 0 {
+			return nil, fmt.Errorf("отрицательное время операции %s: %d мс", name, ms)
+		}
+	}
+	return &times, nil
+}
+
+// all возвращает время каждой заданной операции по символу или имени.
+func (t *OperationTimes) all() map[string]int {
+	all := map[string]int{}
+	for name, ms := range t.Operations {
+		all[name] = ms
+	}
+	for symbol, ms := range map[string]int{"+": t.Addition, "-": t.Subtraction, "*": t.Multiplication, "/": t.Division, "unary-": t.Negation} {
+		if ms != 0 {
+			all[symbol] = ms
+		}
+	}
+	return all
+}
+
+// Durations возвращает время выполнения по символу или имени операции.
+func (t *OperationTimes) Durations() map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	for name, ms := range t.all() {
+		durations[name] = time.Duration(ms) * time.Millisecond
+	}
+	return durations
+}
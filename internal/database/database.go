@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -37,6 +38,11 @@ func (d *Database) Close() error {
 	return d.db.Close()
 }
 
+// DB возвращает подключение для хранилищ, которые ведут собственные таблицы
+func (d *Database) DB() *sql.DB {
+	return d.db
+}
+
 // CreateUser создает нового пользователя в базе данных
 func (d *Database) CreateUser(user *models.User) error {
 	query := `INSERT INTO users (login, password, created_at) VALUES (?, ?, ?)`
@@ -57,33 +63,62 @@ func (d *Database) GetUserByLogin(login string) (*models.User, error) {
 
 // SaveExpression сохраняет выражение в базе данных
 func (d *Database) SaveExpression(expr *models.Expression) error {
-	query := `INSERT INTO expressions (user_id, expression, result, status, created_at, updated_at) 
-		VALUES (?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO expressions (user_id, expression, result, result_value, result_type, seed, status, created_at, updated_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	now := time.Now()
-	_, err := d.db.Exec(query, expr.UserID, expr.Expression, expr.Result, expr.Status, now, now)
+	_, err := d.db.Exec(query, expr.UserID, expr.Expression, expr.Result, expr.ResultValue, expr.ResultType, expr.Seed, expr.Status, now, now)
 	return err
 }
 
-// GetUserExpressions получает все выражения пользователя
-func (d *Database) GetUserExpressions(userID int64) ([]*models.Expression, error) {
-	query := `SELECT id, user_id, expression, result, status, created_at, updated_at 
-		FROM expressions WHERE user_id = ? ORDER BY created_at DESC`
-	rows, err := d.db.Query(query, userID)
+// GetUserExpressions получает страницу выражений пользователя по запросу q и
+// курсор следующей страницы; пустой курсор означает последнюю страницу
+func (d *Database) GetUserExpressions(userID int64, q ExpressionQuery) ([]*models.Expression, string, error) {
+	query, args, err := q.SQL(`SELECT `+expressionColumns+` FROM expressions WHERE user_id = ?`, []any{userID}, "created_at", "result", "id")
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	var expressions []*models.Expression
 	for rows.Next() {
-		expr := &models.Expression{}
-		err := rows.Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Result, &expr.Status, &expr.CreatedAt, &expr.UpdatedAt)
+		expr, err := scanExpression(rows)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		expressions = append(expressions, expr)
 	}
-	return expressions, nil
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if q.Limit > 0 && len(expressions) > q.Limit {
+		expressions = expressions[:q.Limit]
+		last := expressions[q.Limit-1]
+		next = NewCursor(q.Sort, last.CreatedAt, last.Result, strconv.FormatInt(last.ID, 10)).String()
+	}
+	return expressions, next, nil
+}
+
+// GetUserExpression получает выражение пользователя по идентификатору
+func (d *Database) GetUserExpression(userID, id int64) (*models.Expression, error) {
+	query := `SELECT ` + expressionColumns + ` FROM expressions WHERE id = ? AND user_id = ?`
+	return scanExpression(d.db.QueryRow(query, id, userID))
+}
+
+const expressionColumns = `id, user_id, expression, result, result_value, result_type, seed, status, created_at, updated_at`
+
+// scanExpression читает строку со столбцами expressionColumns
+func scanExpression(row interface{ Scan(dest ...any) error }) (*models.Expression, error) {
+	expr := &models.Expression{}
+	err := row.Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Result, &expr.ResultValue, &expr.ResultType, &expr.Seed, &expr.Status, &expr.CreatedAt, &expr.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
 }
 
 // createTables создает необходимые таблицы в базе данных
@@ -108,11 +143,189 @@ func createTables(db *sql.DB) error {
 			user_id INTEGER NOT NULL,
 			expression TEXT NOT NULL,
 			result REAL NOT NULL,
+			result_value TEXT NOT NULL DEFAULT '',
+			result_type TEXT NOT NULL DEFAULT 'number',
+			seed INTEGER,
 			status TEXT NOT NULL,
 			created_at DATETIME NOT NULL,
 			updated_at DATETIME NOT NULL,
 			FOREIGN KEY (user_id) REFERENCES users (id)
 		)
 	`)
+	if err != nil {
+		return err
+	}
+
+	// Создаем таблицы оркестратора: выражения и задачи агентов
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			expression TEXT NOT NULL,
+			status TEXT NOT NULL,
+			result TEXT,
+			error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			owner TEXT NOT NULL DEFAULT '',
+			priority INTEGER NOT NULL DEFAULT 0,
+			callback_url TEXT NOT NULL DEFAULT '',
+			result_number REAL,
+			variables TEXT NOT NULL DEFAULT '',
+			batch_id TEXT NOT NULL DEFAULT '',
+			ref TEXT NOT NULL DEFAULT '',
+			seed INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS tasks (
+			id TEXT PRIMARY KEY,
+			job_id TEXT NOT NULL,
+			node INTEGER NOT NULL,
+			operation TEXT NOT NULL,
+			args TEXT NOT NULL,
+			status TEXT NOT NULL,
+			lease_id TEXT NOT NULL DEFAULT '',
+			deadline INTEGER NOT NULL DEFAULT 0,
+			result REAL NOT NULL DEFAULT 0,
+			seq INTEGER NOT NULL,
+			owner TEXT NOT NULL DEFAULT '',
+			priority INTEGER NOT NULL DEFAULT 0,
+			agent_id TEXT NOT NULL DEFAULT '',
+			mode TEXT NOT NULL DEFAULT 'float64',
+			FOREIGN KEY (job_id) REFERENCES jobs (id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_queue ON tasks (status, seq)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key TEXT PRIMARY KEY,
+			job_id TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// Пакеты выражений, отправленных одним запросом
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS batches (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			size INTEGER NOT NULL,
+			rejected INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// Журнал доставки вебхуков: каждая попытка отдельной строкой
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			job_id TEXT NOT NULL,
+			url TEXT NOT NULL,
+			attempt INTEGER NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			delivered BOOLEAN NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_job ON webhook_deliveries (job_id, id)`)
+	if err != nil {
+		return err
+	}
+
+	// Дополняем таблицы, созданные предыдущими версиями сервиса
+	for _, column := range []struct{ table, name, definition string }{
+		{"expressions", "result_value", "TEXT NOT NULL DEFAULT ''"},
+		{"expressions", "result_type", "TEXT NOT NULL DEFAULT 'number'"},
+		{"expressions", "seed", "INTEGER"},
+		{"jobs", "owner", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "priority", "INTEGER NOT NULL DEFAULT 0"},
+		{"jobs", "callback_url", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "result_number", "REAL"},
+		{"jobs", "variables", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "batch_id", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "ref", "TEXT NOT NULL DEFAULT ''"},
+		{"jobs", "seed", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "owner", "TEXT NOT NULL DEFAULT ''"},
+		{"tasks", "priority", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "agent_id", "TEXT NOT NULL DEFAULT ''"},
+		{"tasks", "mode", "TEXT NOT NULL DEFAULT 'float64'"},
+	} {
+		if err := addColumnIfMissing(db, column.table, column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	// Очередь каждого пользователя: по приоритету, затем в порядке поступления
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_owner ON tasks (owner, priority DESC, seq)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_agent ON tasks (agent_id, status)`)
+	if err != nil {
+		return err
+	}
+
+	// Индексы постраничных списков выражений (сортировка по времени или
+	// результату, фильтр по статусу) и выражений пакета
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_expressions_user_created ON expressions (user_id, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_expressions_user_result ON expressions (user_id, result, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_expressions_user_status ON expressions (user_id, status, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_owner_created ON jobs (owner, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_owner_result ON jobs (owner, result_number, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_owner_status ON jobs (owner, status, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_batch ON jobs (batch_id, id)`,
+	} {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing добавляет столбец в существующую таблицу, если его еще нет
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
 	return err
 } 
\ No newline at end of file
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Ключи сортировки списка выражений
+const (
+	SortCreatedAt = "created_at"
+	SortResult    = "result"
+)
+
+// Размер страницы списка выражений по умолчанию и наибольший допустимый
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// ExpressionQuery задает фильтры, сортировку и страницу списка выражений
+type ExpressionQuery struct {
+	Status string
+	// CreatedFrom и CreatedTo ограничивают время создания: CreatedFrom <= t < CreatedTo;
+	// нулевое время снимает границу
+	CreatedFrom, CreatedTo time.Time
+	// Contains — подстрока текста выражения
+	Contains string
+	// ResultMin и ResultMax ограничивают числовой результат включительно
+	ResultMin, ResultMax *float64
+	// Sort — SortCreatedAt (по умолчанию) или SortResult
+	Sort string
+	Desc bool
+	// Limit — размер страницы; 0 — все выражения
+	Limit int
+	// After — курсор последнего выражения предыдущей страницы
+	After *Cursor
+}
+
+// Cursor указывает на выражение, после которого начинается страница:
+// значение ключа сортировки и ID выражения
+type Cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+// String кодирует курсор для передачи клиенту
+func (c Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseCursor разбирает курсор, полученный от клиента
+func ParseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Неверный курсор")
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("Неверный курсор")
+	}
+	return &c, nil
+}
+
+// CreatedAt возвращает время создания из курсора сортировки SortCreatedAt
+func (c Cursor) CreatedAt() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, c.Key)
+}
+
+// Result возвращает результат из курсора сортировки SortResult
+func (c Cursor) Result() (float64, error) {
+	return strconv.ParseFloat(c.Key, 64)
+}
+
+// NewCursor создает курсор выражения с ключом сортировки sort
+func NewCursor(sort string, createdAt time.Time, result float64, id string) Cursor {
+	if sort == SortResult {
+		return Cursor{Sort: sort, Key: strconv.FormatFloat(result, 'g', -1, 64), ID: id}
+	}
+	return Cursor{Sort: SortCreatedAt, Key: createdAt.Format(time.RFC3339Nano), ID: id}
+}
+
+// ParseExpressionQuery разбирает параметры списка выражений: status, from и to
+// (RFC 3339), q (подстрока выражения), min_result, max_result, sort
+// (created_at или result), order (asc или desc, по умолчанию desc), limit (по
+// умолчанию DefaultPageSize, не больше MaxPageSize) и cursor
+func ParseExpressionQuery(values url.Values) (ExpressionQuery, error) {
+	q := ExpressionQuery{
+		Status:   values.Get("status"),
+		Contains: values.Get("q"),
+		Sort:     SortCreatedAt,
+		Desc:     true,
+		Limit:    DefaultPageSize,
+	}
+	var err error
+	for name, bound := range map[string]*time.Time{"from": &q.CreatedFrom, "to": &q.CreatedTo} {
+		if v := values.Get(name); v != "" {
+			if *bound, err = time.Parse(time.RFC3339, v); err != nil {
+				return q, fmt.Errorf("Неверное время %s: %s", name, v)
+			}
+		}
+	}
+	for name, bound := range map[string]**float64{"min_result": &q.ResultMin, "max_result": &q.ResultMax} {
+		if v := values.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return q, fmt.Errorf("Неверное значение %s: %s", name, v)
+			}
+			*bound = &f
+		}
+	}
+	switch sort := values.Get("sort"); sort {
+	case "", SortCreatedAt:
+	case SortResult:
+		q.Sort = SortResult
+	default:
+		return q, fmt.Errorf("Неизвестная сортировка %s", sort)
+	}
+	switch order := values.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return q, fmt.Errorf("Неизвестный порядок %s", order)
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxPageSize {
+			return q, fmt.Errorf("Параметр limit должен быть от 1 до %d", MaxPageSize)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		if q.After, err = ParseCursor(v); err != nil {
+			return q, err
+		}
+		if q.After.Sort != q.Sort {
+			return q, fmt.Errorf("Курсор получен для другой сортировки")
+		}
+	}
+	return q, nil
+}
+
+// SQL дополняет условие where с аргументами args фильтрами, курсором,
+// сортировкой и лимитом запроса. created, result и id — имена столбцов
+// времени создания, числового результата и ID; сортировка по результату
+// оставляет только выражения с числовым результатом.
+func (q ExpressionQuery) SQL(where string, args []any, created, result, id string) (string, []any, error) {
+	if q.Status != "" {
+		where += ` AND status = ?`
+		args = append(args, q.Status)
+	}
+	if !q.CreatedFrom.IsZero() {
+		where += ` AND ` + created + ` >= ?`
+		args = append(args, q.CreatedFrom.In(time.Local))
+	}
+	if !q.CreatedTo.IsZero() {
+		where += ` AND ` + created + ` < ?`
+		args = append(args, q.CreatedTo.In(time.Local))
+	}
+	if q.Contains != "" {
+		where += ` AND instr(expression, ?) > 0`
+		args = append(args, q.Contains)
+	}
+	if q.ResultMin != nil {
+		where += ` AND ` + result + ` >= ?`
+		args = append(args, *q.ResultMin)
+	}
+	if q.ResultMax != nil {
+		where += ` AND ` + result + ` <= ?`
+		args = append(args, *q.ResultMax)
+	}
+
+	key := created
+	if q.Sort == SortResult {
+		key = result
+		where += ` AND ` + result + ` IS NOT NULL`
+	}
+	cmp, order := ">", "ASC"
+	if q.Desc {
+		cmp, order = "<", "DESC"
+	}
+	if q.After != nil {
+		var value any
+		var err error
+		if q.Sort == SortResult {
+			value, err = q.After.Result()
+		} else {
+			var t time.Time
+			t, err = q.After.CreatedAt()
+			value = t.In(time.Local)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("Неверный курсор")
+		}
+		where += ` AND (` + key + ` ` + cmp + ` ? OR ` + key + ` = ? AND ` + id + ` ` + cmp + ` ?)`
+		args = append(args, value, value, q.After.ID)
+	}
+	where += ` ORDER BY ` + key + ` ` + order + `, ` + id + ` ` + order
+	if q.Limit > 0 {
+		// лишняя строка показывает, что есть следующая страница
+		where += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+	return where, args, nil
+}
@@ -12,13 +12,16 @@ type User struct {
 }
 
 type Expression struct {
-	ID         int64     `json:"id"`
-	UserID     int64     `json:"user_id"`
-	Expression string    `json:"expression"`
-	Result     float64   `json:"result"`
-	Status     string    `json:"status"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"user_id"`
+	Expression  string    `json:"expression"`
+	Result      float64   `json:"result"`
+	ResultValue string    `json:"result_value"`
+	ResultType  string    `json:"result_type"`
+	Seed        *int64    `json:"seed,omitempty"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type RegisterRequest struct {
@@ -33,4 +36,4 @@ type LoginRequest struct {
 
 type LoginResponse struct {
 	Token string `json:"token"`
-} 
\ No newline at end of file
+}
@@ -0,0 +1,83 @@
+package rates
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
+)
+
+// Watcher следит за файлом курсов валют и перечитывает его при изменении
+type Watcher struct {
+	path    string
+	mu      sync.RWMutex
+	rates   *calculator.Rates
+	modTime time.Time
+	done    chan struct{}
+}
+
+// NewWatcher загружает курсы из файла и раз в interval проверяет, не изменился ли он
+func NewWatcher(path string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{path: path, done: make(chan struct{})}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.reload(); err != nil {
+					// Оставляем последние корректные курсы
+					log.Printf("Ошибка обновления курсов валют: %v", err)
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Rates возвращает актуальные курсы валют
+func (w *Watcher) Rates() *calculator.Rates {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.rates
+}
+
+// Close останавливает отслеживание файла
+func (w *Watcher) Close() {
+	close(w.done)
+}
+
+// reload перечитывает файл, если время его изменения поменялось
+func (w *Watcher) reload() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.RLock()
+	unchanged := w.rates != nil && info.ModTime().Equal(w.modTime)
+	w.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	rates, err := calculator.LoadRates(w.path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.rates = rates
+	w.modTime = info.ModTime()
+	w.mu.Unlock()
+	log.Printf("Курсы валют загружены из %s", w.path)
+	return nil
+}
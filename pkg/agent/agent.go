@@ -2,10 +2,16 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"log"
 	"net/http"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
 )
 
 type Task struct {
@@ -13,39 +19,272 @@ type Task struct {
 	Arg1      float64 `json:"arg1"`
 	Arg2      float64 `json:"arg2"`
 	Operation string  `json:"operation"`
+	// Args задает аргументы функций с числом аргументов, отличным от двух
+	Args []float64 `json:"args,omitempty"`
+	// LeaseID подтверждает, что задача выдана этому агенту; его нужно
+	// вернуть вместе с результатом до LeaseDeadline
+	LeaseID       string     `json:"lease_id,omitempty"`
+	LeaseDeadline *time.Time `json:"lease_deadline,omitempty"`
+	// OperationTime — имитируемое время выполнения операции в миллисекундах
+	OperationTime int64 `json:"operation_time,omitempty"`
+	// Mode — режим, в котором нужно выполнить операцию; пустой означает ModeFloat
+	Mode string `json:"mode,omitempty"`
+}
+
+// Result — результат задачи, отправляемый оркестратору. Если операция
+// завершилась ошибкой, она передается в Error.
+type Result struct {
+	ID      string  `json:"id"`
+	LeaseID string  `json:"lease_id,omitempty"`
+	Result  float64 `json:"result"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Registration описывает агента при регистрации у оркестратора. Агент без
+// ID получает его в ответе.
+type Registration struct {
+	ID          string `json:"id,omitempty"`
+	Hostname    string `json:"hostname"`
+	Version     string `json:"version"`
+	Concurrency int    `json:"concurrency"`
+	// Operations — операторы и функции, которые умеет выполнять агент;
+	// пустой список означает любые операции
+	Operations []string `json:"operations"`
+	// Modes — числовые режимы, в которых агент выполняет операции; пустой
+	// список означает ModeFloat
+	Modes []string `json:"modes,omitempty"`
+}
+
+// ModeFloat — вычисления над float64, режим задач по умолчанию. Другие
+// режимы (например, prob для вероятностных функций) оркестратор назначает операциям через
+// OperationModes; операции над датами, десятичными и точными целыми он
+// выполняет сам.
+const ModeFloat = "float64"
+
+// Heartbeat продлевает аренду выполняемой задачи.
+type Heartbeat struct {
+	LeaseID string `json:"lease_id"`
 }
 
+// OrchestratorURL — адрес оркестратора, у которого агент берет задачи.
+var OrchestratorURL = "http://localhost:8080"
+
+// Version — версия агента, сообщаемая при регистрации.
+var Version = "dev"
+
+// Operations ограничивает операции, которые агент берет у оркестратора;
+// пустой список означает все операции calculator.DefaultRegistry.
+var Operations []string
+
+// Modes — числовые режимы, которые агент сообщает оркестратору.
+var Modes = []string{ModeFloat}
+
+// Concurrency — число задач, которые агент выполняет одновременно.
+var Concurrency = 1
+
+// PollWait — сколько оркестратор держит запрос агента за задачей, если
+// готовых задач нет.
+var PollWait = 30 * time.Second
+
+// HeartbeatInterval — как часто агент продлевает аренду выполняемой задачи и
+// проверяет, что она еще нужна.
+var HeartbeatInterval = 10 * time.Second
+
+// StartAgent регистрирует агента у оркестратора, поддерживает регистрацию
+// heartbeat-запросами и запускает Concurrency обработчиков задач.
 func StartAgent() {
+	if Concurrency < 1 {
+		Concurrency = 1
+	}
+	register()
+	for i := 1; i < Concurrency; i++ {
+		go work()
+	}
+	go keepAlive()
+	work()
+}
+
+var (
+	idMu sync.Mutex
+	// agentID — идентификатор, выданный оркестратором при регистрации
+	agentID string
+)
+
+func currentID() string {
+	idMu.Lock()
+	defer idMu.Unlock()
+	return agentID
+}
+
+// register регистрирует агента и запоминает выданный ID. Повторная
+// регистрация после удаления из реестра сохраняет прежний ID. Пока
+// оркестратор недоступен, попытки повторяются.
+func register() {
+	hostname, _ := os.Hostname()
+	operations := Operations
+	if len(operations) == 0 {
+		operations = calculator.DefaultRegistry.Operations()
+	}
+	for {
+		body, _ := json.Marshal(Registration{
+			ID:          currentID(),
+			Hostname:    hostname,
+			Version:     Version,
+			Concurrency: Concurrency,
+			Operations:  operations,
+			Modes:       Modes,
+		})
+		resp, err := http.Post(OrchestratorURL+"/internal/agents", "application/json", bytes.NewBuffer(body))
+		if err == nil {
+			var created struct {
+				Agent Registration `json:"agent"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&created)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusCreated {
+				idMu.Lock()
+				agentID = created.Agent.ID
+				idMu.Unlock()
+				return
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// keepAlive отправляет heartbeat каждые HeartbeatInterval и регистрирует
+// агента заново, если оркестратор его забыл.
+func keepAlive() {
+	for range time.Tick(HeartbeatInterval) {
+		resp, err := http.Post(OrchestratorURL+"/internal/agents/"+currentID()+"/heartbeat", "application/json", nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			register()
+		}
+	}
+}
+
+// work получает задачи долгим опросом и выполняет их по одной.
+func work() {
 	for {
-		resp, err := http.Get("http://localhost/internal/task")
+		resp, err := http.Get(OrchestratorURL + "/internal/task?wait=" + PollWait.String() + "&agent=" + currentID())
 		if err != nil {
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		if resp.StatusCode == http.StatusOK {
+		switch resp.StatusCode {
+		case http.StatusOK:
 			var task Task
-			if err := json.NewDecoder(resp.Body).Decode(&task); err == nil {
-				result := performOperation(task)
-				http.Post("http://localhost/internal/task", "application/json", bytes.NewBuffer([]byte(fmt.Sprintf(`{"id": "%v", "result": %v}`, task.ID, result))))
+			err := json.NewDecoder(resp.Body).Decode(&task)
+			resp.Body.Close()
+			if err == nil {
+				processTask(task)
 			}
-		} else {
+		case http.StatusNotFound:
+			// за время ожидания задач не появилось — сразу ждем снова
+			resp.Body.Close()
+		case http.StatusGone:
+			// оркестратор удалил агента из реестра
+			resp.Body.Close()
+			register()
+		default:
+			resp.Body.Close()
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
 
-func performOperation(task Task) float64 {
-	switch task.Operation {
-	case "+":
-		return task.Arg1 + task.Arg2
-	case "-":
-		return task.Arg1 - task.Arg2
-	case "*":
-		return task.Arg1 * task.Arg2
-	case "/":
-		return task.Arg1 / task.Arg2
-	default:
-		return 0
+// processTask выполняет задачу, продлевая ее аренду каждые HeartbeatInterval,
+// и отправляет результат. Если оркестратор отвечает, что задача больше не
+// нужна (выражение отменено или аренда передана другому агенту), работа
+// бросается.
+func processTask(task Task) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan Result, 1)
+	go func() {
+		result := Result{ID: task.ID, LeaseID: task.LeaseID}
+		value, err := executeTask(ctx, task)
+		result.Result = value
+		if err != nil {
+			result.Error = err.Error()
+		}
+		done <- result
+	}()
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result := <-done:
+			body, _ := json.Marshal(result)
+			resp, err := http.Post(OrchestratorURL+"/internal/task", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusGone {
+				log.Printf("Результат задачи %s не нужен: выражение отменено", task.ID)
+			}
+			return
+		case <-ticker.C:
+			if !heartbeat(task) {
+				log.Printf("Задача %s отменена, выполнение прекращено", task.ID)
+				return
+			}
+		}
+	}
+}
+
+// heartbeat продлевает аренду задачи. Возвращает false, если задачу нужно
+// бросить; при сетевой ошибке работа продолжается, пока действует аренда.
+func heartbeat(task Task) bool {
+	body, _ := json.Marshal(Heartbeat{LeaseID: task.LeaseID})
+	resp, err := http.Post(OrchestratorURL+"/internal/task/"+task.ID+"/heartbeat", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return true
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusConflict, http.StatusGone:
+		return false
+	}
+	return true
+}
+
+// executeTask ждет OperationTime и выполняет операцию или функцию,
+// зарегистрированную в calculator.DefaultRegistry; отмена ctx прерывает
+// ожидание.
+func executeTask(ctx context.Context, task Task) (float64, error) {
+	if task.OperationTime > 0 {
+		timer := time.NewTimer(time.Duration(task.OperationTime) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	args := []calculator.Value{calculator.Number(task.Arg1), calculator.Number(task.Arg2)}
+	if task.Args != nil {
+		args = args[:0]
+		for _, arg := range task.Args {
+			args = append(args, calculator.Number(arg))
+		}
+	}
+
+	result, err := calculator.DefaultRegistry.Apply(task.Operation, args...)
+	if err != nil {
+		return 0, err
+	}
+	num, ok := result.Float()
+	if !ok {
+		return 0, errors.New("результат не является числом")
 	}
+	return num, nil
 }
@@ -2,13 +2,17 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
 )
 
 type MockOrchestrator struct {
@@ -78,7 +82,10 @@ func TestAgent(t *testing.T) {
 				var task Task
 				if err := json.NewDecoder(resp.Body).Decode(&task); err == nil {
 					// Выполнить задачу
-					result := performOperation(task)
+					result, err := executeTask(context.Background(), task)
+					if err != nil {
+						t.Errorf("executeTask(%v) returned error: %v", task, err)
+					}
 					// Отправить результат
 					http.Post(agentURL, "application/json", bytes.NewBuffer([]byte(fmt.Sprintf(`{"id": "%v", "result": %v}`, task.ID, result))))
 				}
@@ -113,3 +120,158 @@ func TestAgent(t *testing.T) {
 		}
 	}
 }
+
+func TestExecuteTaskRegistry(t *testing.T) {
+	tests := []struct {
+		task     Task
+		expected float64
+		// err — ожидаемый текст ошибки, code — ее код для ошибок с кодом
+		err  string
+		code string
+	}{
+		{Task{ID: "1", Arg1: 6, Arg2: 3, Operation: "/"}, 2, "", ""},
+		{Task{ID: "2", Operation: "mean", Args: []float64{1, 2, 3, 6}}, 3, "", ""},
+		{Task{ID: "3", Operation: "normcdf", Args: []float64{0}}, 0.5, "", ""},
+		{Task{ID: "4", Arg1: 1, Arg2: 0, Operation: "/"}, 0, "Деление на ноль", ""},
+		{Task{ID: "5", Operation: "norminv", Args: []float64{2}}, 0, "", calculator.CodeProbabilityRange},
+		{Task{ID: "6", Operation: "poissoninv", Args: []float64{0.5, 1e20}}, 0, "", calculator.CodeInvalidParameter},
+	}
+
+	for _, test := range tests {
+		result, err := executeTask(context.Background(), test.task)
+		if result != test.expected {
+			t.Errorf("executeTask(%v) = %v, expected %v", test.task, result, test.expected)
+		}
+		var calcErr *calculator.Error
+		switch {
+		case test.code != "":
+			if !errors.As(err, &calcErr) || calcErr.Code != test.code {
+				t.Errorf("executeTask(%v) returned error %v, expected code %s", test.task, err, test.code)
+			}
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("executeTask(%v) returned error %v, expected %q", test.task, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("executeTask(%v) returned error: %v", test.task, err)
+		}
+	}
+}
+
+func TestProcessTaskCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	calculator.RegisterFunction(calculator.Function{
+		Name: "slow", MinArgs: 1, MaxArgs: 1, Pure: true,
+		Call: func(args []calculator.Value) (calculator.Value, error) {
+			<-release
+			return args[0], nil
+		},
+	})
+
+	var mu sync.Mutex
+	heartbeats, results := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/internal/task/1/heartbeat" {
+			heartbeats++
+			// первое продление проходит, ко второму выражение уже отменено
+			if heartbeats > 1 {
+				w.WriteHeader(http.StatusGone)
+			}
+			return
+		}
+		results++
+	}))
+	defer server.Close()
+
+	defer func(url string, interval time.Duration) { OrchestratorURL, HeartbeatInterval = url, interval }(OrchestratorURL, HeartbeatInterval)
+	OrchestratorURL, HeartbeatInterval = server.URL, 10*time.Millisecond
+
+	finished := make(chan struct{})
+	go func() {
+		processTask(Task{ID: "1", Operation: "slow", Args: []float64{1}, LeaseID: "lease"})
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent must abandon a cancelled task")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if heartbeats != 2 || results != 0 {
+		t.Errorf("expected 2 heartbeats and no results, got %d and %d", heartbeats, results)
+	}
+}
+
+func TestExecuteTaskOperationTime(t *testing.T) {
+	task := Task{ID: "1", Arg1: 2, Arg2: 3, Operation: "*", OperationTime: 50}
+	start := time.Now()
+	if result, err := executeTask(context.Background(), task); err != nil || result != 6 {
+		t.Errorf("executeTask(%v) = %v, %v, expected 6", task, result, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("operation finished after %v, expected at least 50ms", elapsed)
+	}
+
+	// отмена прерывает имитацию долгой операции
+	task.OperationTime = 10000
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := executeTask(ctx, task); err != context.DeadlineExceeded {
+		t.Errorf("expected the operation to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled operation took %v", elapsed)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var registrations []Registration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reg Registration
+		json.NewDecoder(r.Body).Decode(&reg)
+		registrations = append(registrations, reg)
+		if reg.ID == "" {
+			reg.ID = "agent-1"
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]Registration{"agent": reg})
+	}))
+	defer server.Close()
+	defer func(url string) { OrchestratorURL, agentID = url, "" }(OrchestratorURL)
+	OrchestratorURL = server.URL
+
+	register()
+	// после удаления из реестра агент регистрируется с прежним ID
+	register()
+	if currentID() != "agent-1" || len(registrations) != 2 || registrations[1].ID != "agent-1" {
+		t.Fatalf("unexpected registrations %+v, agent ID %q", registrations, currentID())
+	}
+	reg := registrations[0]
+	if reg.Concurrency != Concurrency || reg.Version != Version || !contains(reg.Operations, "+") || !contains(reg.Operations, "mean") ||
+		!contains(reg.Modes, ModeFloat) {
+		t.Errorf("unexpected registration %+v", reg)
+	}
+
+	// специализированный агент сообщает только свои операции
+	defer func() { Operations = nil }()
+	Operations = []string{"+", "-"}
+	register()
+	if reg := registrations[2]; len(reg.Operations) != 2 || contains(reg.Operations, "mean") {
+		t.Errorf("unexpected operations %v", reg.Operations)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
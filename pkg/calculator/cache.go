@@ -0,0 +1,201 @@
+package calculator
+
+import (
+	lru "container/list"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commutative — операции, результат которых не зависит от порядка двух
+// аргументов.
+var commutative = map[string]bool{"+": true, "*": true}
+
+// operandKey возвращает канонический ключ аргумента; ok ложно, если аргумент
+// зависит от недетерминированной функции.
+func operandKey(o Operand, keys []string) (key string, ok bool) {
+	if o.Literal {
+		return strconv.Quote(valueKey(o.Value)), true
+	}
+	return keys[o.Node], keys[o.Node] != ""
+}
+
+// valueKey возвращает ключ литерала без потери точности: целые литералы
+// больше 2^53 различаются точным значением, а не округленным float64.
+func valueKey(v Value) string {
+	key := v.kind.String() + ":" + v.String()
+	if v.integer != nil {
+		key += ":" + v.integer.String()
+	}
+	return key
+}
+
+// nodeKey возвращает канонический ключ узла по ключам предыдущих узлов:
+// операция и ключи аргументов, у коммутативных операций — упорядоченные.
+// Узлы недетерминированных функций и зависящие от них получают пустой ключ.
+func nodeKey(node Node, keys []string) string {
+	if !node.Pure {
+		return ""
+	}
+	parts := make([]string, len(node.Operands))
+	for i, operand := range node.Operands {
+		key, ok := operandKey(operand, keys)
+		if !ok {
+			return ""
+		}
+		parts[i] = key
+	}
+	if commutative[node.Operation] && len(parts) == 2 {
+		sort.Strings(parts)
+	}
+	return node.Operation + "(" + strings.Join(parts, ",") + ")"
+}
+
+// Keys возвращает канонические ключи узлов графа. Одинаковые ключи имеют
+// подвыражения, которые различаются только пробелами и порядком аргументов
+// сложения и умножения; пустой ключ — у подвыражений с недетерминированными
+// функциями, результат которых нельзя переиспользовать.
+func (g *Graph) Keys() []string {
+	if len(g.keys) == len(g.Nodes) {
+		return g.keys
+	}
+	keys := make([]string, len(g.Nodes))
+	for _, node := range g.Nodes {
+		keys[node.ID] = nodeKey(node, keys)
+	}
+	return keys
+}
+
+// Key возвращает канонический ключ всего выражения или пустую строку, если
+// выражение содержит недетерминированные функции.
+func (g *Graph) Key() string {
+	key, _ := operandKey(g.Result, g.Keys())
+	return key
+}
+
+// Cache хранит результаты чистых выражений и подвыражений по каноническому
+// ключу не дольше TTL; при переполнении вытесняются давно не использованные
+// записи. Нулевой *Cache ничего не хранит. Безопасен для одновременного
+// использования.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*lru.Element
+	// order — записи от недавно использованных к давно не использованным
+	order        *lru.List
+	hits, misses uint64
+}
+
+type cacheEntry struct {
+	key     string
+	value   Value
+	expires time.Time
+}
+
+// CacheStats — состояние кэша.
+type CacheStats struct {
+	Entries  int     `json:"entries"`
+	Capacity int     `json:"capacity"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// NewCache создает кэш на size записей со сроком жизни ttl. Без
+// положительного size возвращает nil — кэш отключен.
+func NewCache(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{size: size, ttl: ttl, entries: map[string]*lru.Element{}, order: lru.New()}
+}
+
+// Get возвращает значение по ключу, если срок записи не истек.
+func (c *Cache) Get(key string) (Value, bool) {
+	if c == nil {
+		return Value{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.ttl > 0 && time.Now().After(el.Value.(*cacheEntry).expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return Value{}, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// Put сохраняет значение по ключу.
+func (c *Cache) Put(key string, value Value) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Stats возвращает число записей, попаданий и промахов кэша.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := CacheStats{Entries: c.order.Len(), Capacity: c.size, Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// evaluateCached вычисляет выражение через opts.Cache. Ключ учитывает
+// параметры, от которых результат зависит помимо текста выражения;
+// выражения с недетерминированными функциями и ошибки не кэшируются.
+func evaluateCached(expression string, opts Options) (Value, error) {
+	cache := opts.Cache
+	opts.Cache = nil
+	g, err := PlanWithOptions(expression, opts)
+	if err != nil || g.Key() == "" {
+		// ошибки разбора возвращает само вычисление
+		return Evaluate(expression, opts)
+	}
+	key := g.Key()
+	if opts.Decimal != nil {
+		key = fmt.Sprintf("decimal(%d,%d) ", opts.Decimal.Scale, opts.Decimal.Rounding) + key
+	}
+	if opts.Location != nil {
+		key = opts.Location.String() + " " + key
+	}
+	key = fmt.Sprintf("%p %p ", opts.Registry, opts.Rates) + key
+	if value, ok := cache.Get(key); ok {
+		return value, nil
+	}
+	value, err := Evaluate(expression, opts)
+	if err == nil {
+		cache.Put(key, value)
+	}
+	return value, err
+}
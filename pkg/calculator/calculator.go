@@ -2,86 +2,452 @@ package calculator
 
 import (
 	"errors"
+	"math"
+	"math/big"
+	"math/rand"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenTime
+	tokenDuration
+	tokenMoney
+	tokenUnit
+	tokenVariable
+	tokenOperator
+	tokenFunction
+	tokenList
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+)
+
+// token — лексема выражения. Для функций и списков в ОПЗ argc хранит
+// количество аргументов (элементов), для операторов — 1 у префиксных и 2
+// у инфиксных.
+type token struct {
+	kind tokenKind
+	text string
+	argc int
+	// implicit отмечает умножение, подставленное при разборе: 2(3+4), 2pi
+	implicit bool
+}
+
+// ImplicitPrecedence задает приоритет неявного умножения.
+type ImplicitPrecedence int
+
+const (
+	// ImplicitTextbook — как в учебниках: неявное умножение связывает
+	// сильнее деления, 1/2x = 1/(2x).
+	ImplicitTextbook ImplicitPrecedence = iota
+	// ImplicitCalculator — как в калькуляторах: неявное умножение равно
+	// явному и выполняется слева направо, 1/2x = (1/2)x.
+	ImplicitCalculator
+)
+
+// ParseImplicit разбирает название соглашения: textbook или calculator.
+func ParseImplicit(s string) (ImplicitPrecedence, error) {
+	switch s {
+	case "textbook", "":
+		return ImplicitTextbook, nil
+	case "calculator":
+		return ImplicitCalculator, nil
+	}
+	return 0, errors.New("Неизвестное соглашение о неявном умножении " + s)
+}
+
+// Options задает окружение вычисления.
+type Options struct {
+	// Location — часовой пояс для дат без явного смещения и функций now()
+	// и today(). По умолчанию UTC.
+	Location *time.Location
+	// Now — источник текущего времени. По умолчанию time.Now.
+	Now func() time.Time
+	// Decimal включает точную десятичную арифметику с фиксированной
+	// точкой: числа не переводятся в float64, результат округляется до
+	// Decimal.Scale знаков.
+	Decimal *DecimalOptions
+	// Rates — курсы для пересчета денежных сумм вида 100 USD.
+	Rates *Rates
+	// Registry — функции и операторы выражения. По умолчанию DefaultRegistry.
+	Registry *Registry
+	// Vars — значения переменных, на которые ссылается выражение.
+	// Переменные перекрывают встроенные константы pi и e.
+	Vars map[string]Value
+	// Strict запрещает неявное умножение вида 2(3+4), (a+b)(a-b), 2pi, 3x.
+	Strict bool
+	// Implicit задает приоритет неявного умножения.
+	Implicit ImplicitPrecedence
+	// Seed — начальное значение генератора для rand(), randint(), randn()
+	// и choice(). С одним и тем же Seed выражение дает тот же результат.
+	// Если не задан, генератор инициализируется текущим временем.
+	Seed *int64
+	// Cache — кэш результатов: выражение, уже вычисленное с теми же
+	// параметрами, не вычисляется повторно. Выражения с
+	// недетерминированными функциями не кэшируются.
+	Cache *Cache
+}
+
+// env — окружение одного вычисления.
+type env struct {
+	opts Options
+	rng  *rand.Rand
+}
+
+func (e *env) location() *time.Location {
+	if e.opts.Location != nil {
+		return e.opts.Location
+	}
+	return time.UTC
+}
+
+func (e *env) now() time.Time {
+	now := time.Now
+	if e.opts.Now != nil {
+		now = e.opts.Now
+	}
+	return now().In(e.location())
+}
+
+func (e *env) registry() *Registry {
+	if e.opts.Registry != nil {
+		return e.opts.Registry
+	}
+	return DefaultRegistry
+}
+
+// random возвращает генератор вычисления; все вызовы случайных функций в
+// одном выражении берут числа из одной последовательности.
+func (e *env) random() *rand.Rand {
+	if e.rng == nil {
+		seed := time.Now().UnixNano()
+		if e.opts.Seed != nil {
+			seed = *e.opts.Seed
+		}
+		e.rng = rand.New(rand.NewSource(seed))
+	}
+	return e.rng
+}
+
+func (e *env) decimal() DecimalOptions {
+	if e.opts.Decimal != nil {
+		return *e.opts.Decimal
+	}
+	return defaultDecimal
+}
+
+// Calc вычисляет выражение, результатом которого должно быть число.
 func Calc(expression string) (float64, error) {
-	expression = strings.Replace(expression, " ", "", -1)
-	tokens, err := tokenize(expression)
+	result, err := Evaluate(expression, Options{})
 	if err != nil {
 		return 0, err
 	}
-	rpn, err := toRPN(tokens)
+	num, ok := result.Float()
+	if !ok {
+		return 0, errors.New("Результат не является числом")
+	}
+	return num, nil
+}
+
+// Evaluate вычисляет выражение произвольного типа: число, список, дату,
+// длительность или денежную сумму.
+func Evaluate(expression string, opts Options) (Value, error) {
+	if opts.Cache != nil {
+		return evaluateCached(expression, opts)
+	}
+	e := &env{opts: opts}
+	rpn, err := compile(expression, opts)
 	if err != nil {
-		return 0, err
+		return Value{}, err
 	}
-	result, err := evaluateRPN(rpn)
+	return e.run(rpn)
+}
+
+// compile переводит выражение в обратную польскую запись.
+func compile(expression string, opts Options) ([]token, error) {
+	reg := (&env{opts: opts}).registry()
+	tokens, err := tokenize(expression, reg)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	tokens, err = insertImplicit(tokens, opts)
+	if err != nil {
+		return nil, err
+	}
+	return toRPN(tokens, reg)
+}
+
+// run вычисляет выражение в обратной польской записи и округляет
+// десятичный результат.
+func (e *env) run(rpn []token) (Value, error) {
+	result, err := evaluateRPN(rpn, e)
+	if err != nil {
+		return Value{}, err
+	}
+	if result.kind == KindDecimal {
+		result.dec = result.dec.round(e.decimal().Scale, e.decimal().Rounding)
 	}
 	return result, nil
 }
 
-func tokenize(expression string) ([]string, error) {
-	var tokens []string
-	var current strings.Builder
-	for _, c := range expression {
+func tokenize(expression string, reg *Registry) ([]token, error) {
+	var tokens []token
+	runes := []rune(expression)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
 		switch {
+		case unicode.IsSpace(c):
+			continue
 		case c >= '0' && c <= '9' || c == '.':
-			current.WriteRune(c)
-		case c == '+' || c == '-' || c == '*' || c == '/' || c == '(' || c == ')':
-			if current.Len() > 0 {
-				tokens = append(tokens, current.String())
-				current.Reset()
+			rest := string(runes[i:])
+			if m := dateLiteral.FindString(rest); m != "" {
+				tokens = append(tokens, token{kind: tokenTime, text: m})
+				i += len([]rune(m)) - 1
+				continue
+			}
+			// длительность разбирается раньше неявного умножения: 3m — три
+			// минуты, а не 3 * m, даже если переменная m задана
+			if m := durationLiteral.FindString(rest); m != "" && !followedByLetter(runes, i+len([]rune(m))) {
+				tokens = append(tokens, token{kind: tokenDuration, text: m})
+				i += len([]rune(m)) - 1
+				continue
+			}
+			start := i
+			for i+1 < len(runes) && (runes[i+1] >= '0' && runes[i+1] <= '9' || runes[i+1] == '.') {
+				i++
+			}
+			num := string(runes[start : i+1])
+			if currency, next := readUnit(runes, i+1); currencyCode.MatchString(currency) && nextNonSpace(runes, next) != '(' {
+				tokens = append(tokens, token{kind: tokenMoney, text: num + " " + currency})
+				i = next - 1
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: num})
+		case isLetter(c):
+			start := i
+			for i+1 < len(runes) && (isLetter(runes[i+1]) || runes[i+1] >= '0' && runes[i+1] <= '9') {
+				i++
+			}
+			name := string(runes[start : i+1])
+			if name == "in" && len(tokens) > 0 && endsOperand(tokens[len(tokens)-1]) {
+				tokens = append(tokens, token{kind: tokenOperator, text: "in", argc: 2})
+				unit, next := readUnit(runes, i+1)
+				if unit == "" {
+					return nil, errors.New("Не указана единица измерения после in")
+				}
+				tokens = append(tokens, token{kind: tokenUnit, text: unit})
+				i = next - 1
+				continue
+			}
+			if _, ok := reg.Operator(name, false); ok && len(tokens) > 0 && endsOperand(tokens[len(tokens)-1]) {
+				tokens = append(tokens, token{kind: tokenOperator, text: name, argc: 2})
+				continue
 			}
-			tokens = append(tokens, string(c))
+			if _, ok := reg.Operator(name, true); ok && (len(tokens) == 0 || !endsOperand(tokens[len(tokens)-1])) {
+				tokens = append(tokens, token{kind: tokenOperator, text: name, argc: 1})
+				continue
+			}
+			if _, ok := reg.Function(name); ok && nextNonSpace(runes, i+1) == '(' {
+				tokens = append(tokens, token{kind: tokenFunction, text: name})
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenVariable, text: name})
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLeftParen, text: "("})
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRightParen, text: ")"})
+		case c == '[':
+			tokens = append(tokens, token{kind: tokenLeftBracket, text: "["})
+		case c == ']':
+			tokens = append(tokens, token{kind: tokenRightBracket, text: "]"})
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ","})
 		default:
-			return nil, errors.New("Недопустимый символ в выражении")
+			symbol := reg.matchOperator(runes, i)
+			if symbol == "" {
+				return nil, errors.New("Недопустимый символ в выражении")
+			}
+			// оператор в позиции операнда считается префиксным, если такой зарегистрирован
+			argc := 2
+			if _, ok := reg.Operator(symbol, true); ok && (len(tokens) == 0 || !endsOperand(tokens[len(tokens)-1])) {
+				argc = 1
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: symbol, argc: argc})
+			i += len([]rune(symbol)) - 1
 		}
 	}
-	if current.Len() > 0 {
-		tokens = append(tokens, current.String())
-	}
 	return tokens, nil
 }
 
-func toRPN(tokens []string) ([]string, error) {
-	var rpn []string
-	var stack []string
-	precedence := map[string]int{
-		"+": 1, "-": 1, "*": 2, "/": 2,
+// insertImplicit вставляет умножение между операндом и следующей за ним
+// скобкой, переменной или функцией: 2(3+4), (a+b)(a-b), 2pi, 3x, x sqrt(2).
+func insertImplicit(tokens []token, opts Options) ([]token, error) {
+	var result []token
+	for i, tok := range tokens {
+		if i > 0 && implicitBetween(tokens[i-1], tok) {
+			if opts.Strict {
+				return nil, errors.New("Неявное умножение запрещено в строгом режиме")
+			}
+			result = append(result, token{kind: tokenOperator, text: "*", argc: 2, implicit: opts.Implicit == ImplicitTextbook})
+		}
+		result = append(result, tok)
+	}
+	return result, nil
+}
+
+func implicitBetween(left, right token) bool {
+	switch left.kind {
+	case tokenNumber, tokenVariable, tokenRightParen:
+	default:
+		return false
+	}
+	switch right.kind {
+	case tokenVariable, tokenFunction, tokenLeftParen:
+		return true
+	}
+	return false
+}
+
+// endsOperand сообщает, может ли лексема завершать операнд.
+func endsOperand(tok token) bool {
+	switch tok.kind {
+	case tokenNumber, tokenTime, tokenDuration, tokenMoney, tokenVariable, tokenRightParen, tokenRightBracket:
+		return true
+	}
+	return false
+}
+
+// readUnit читает единицу измерения, часовой пояс или код валюты,
+// например days, Europe/Moscow или USD.
+func readUnit(runes []rune, i int) (string, int) {
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
+	}
+	start := i
+	for i < len(runes) && (isLetter(runes[i]) || runes[i] >= '0' && runes[i] <= '9' || runes[i] == '/') {
+		i++
+	}
+	return string(runes[start:i]), i
+}
+
+func nextNonSpace(runes []rune, i int) rune {
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
+	}
+	if i < len(runes) {
+		return runes[i]
+	}
+	return 0
+}
+
+func followedByLetter(runes []rune, i int) bool {
+	return i < len(runes) && isLetter(runes[i])
+}
+
+func isLetter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// operatorInfo возвращает приоритет и ассоциативность оператора. Оператор
+// in имеет наименьший приоритет. Приоритеты удваиваются, чтобы неявное
+// умножение по учебному соглашению встало между явным умножением и
+// следующим по старшинству оператором.
+func operatorInfo(tok token, reg *Registry) (int, Associativity) {
+	if tok.text == "in" && tok.argc == 2 {
+		return 0, LeftAssoc
+	}
+	op, _ := reg.Operator(tok.text, tok.argc == 1)
+	if tok.implicit {
+		return op.Precedence*2 + 1, op.Assoc
 	}
-	for _, token := range tokens {
-		switch token {
-		case "+", "-", "*", "/":
+	return op.Precedence * 2, op.Assoc
+}
+
+func toRPN(tokens []token, reg *Registry) ([]token, error) {
+	var rpn []token
+	var stack []token
+	// counts хранит количество аргументов для каждой открытой скобки
+	var counts []int
+	for i, tok := range tokens {
+		switch tok.kind {
+		case tokenOperator:
+			if tok.argc == 1 {
+				stack = append(stack, tok)
+				continue
+			}
+			precedence, assoc := operatorInfo(tok, reg)
 			for len(stack) > 0 {
 				top := stack[len(stack)-1]
-				if top == "(" || precedence[top] < precedence[token] {
+				if top.kind != tokenOperator {
+					break
+				}
+				topPrecedence, _ := operatorInfo(top, reg)
+				if topPrecedence < precedence || topPrecedence == precedence && assoc == RightAssoc {
 					break
 				}
 				rpn = append(rpn, top)
 				stack = stack[:len(stack)-1]
 			}
-			stack = append(stack, token)
-		case "(":
-			stack = append(stack, token)
-		case ")":
-			for len(stack) > 0 && stack[len(stack)-1] != "(" {
+			stack = append(stack, tok)
+		case tokenFunction:
+			stack = append(stack, tok)
+		case tokenLeftParen, tokenLeftBracket:
+			stack = append(stack, tok)
+			if i+1 < len(tokens) && (tokens[i+1].kind == tokenRightParen || tokens[i+1].kind == tokenRightBracket) {
+				counts = append(counts, 0)
+			} else {
+				counts = append(counts, 1)
+			}
+		case tokenComma:
+			for len(stack) > 0 && stack[len(stack)-1].kind != tokenLeftParen && stack[len(stack)-1].kind != tokenLeftBracket {
 				rpn = append(rpn, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
 			if len(stack) == 0 {
+				return nil, errors.New("Запятая вне списка аргументов")
+			}
+			if stack[len(stack)-1].kind == tokenLeftParen && (len(stack) < 2 || stack[len(stack)-2].kind != tokenFunction) {
+				return nil, errors.New("Запятая вне списка аргументов")
+			}
+			counts[len(counts)-1]++
+		case tokenRightParen, tokenRightBracket:
+			open := tokenLeftParen
+			if tok.kind == tokenRightBracket {
+				open = tokenLeftBracket
+			}
+			for len(stack) > 0 && stack[len(stack)-1].kind != tokenLeftParen && stack[len(stack)-1].kind != tokenLeftBracket {
+				rpn = append(rpn, stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 || stack[len(stack)-1].kind != open {
 				return nil, errors.New("Несовпадение скобок")
 			}
 			stack = stack[:len(stack)-1]
+			argc := counts[len(counts)-1]
+			counts = counts[:len(counts)-1]
+			if open == tokenLeftBracket {
+				rpn = append(rpn, token{kind: tokenList, text: "[]", argc: argc})
+			} else if len(stack) > 0 && stack[len(stack)-1].kind == tokenFunction {
+				fn := stack[len(stack)-1]
+				fn.argc = argc
+				rpn = append(rpn, fn)
+				stack = stack[:len(stack)-1]
+			}
 		default:
-			rpn = append(rpn, token)
+			rpn = append(rpn, tok)
 		}
 	}
 	for len(stack) > 0 {
 		top := stack[len(stack)-1]
-		if top == "(" {
+		if top.kind == tokenLeftParen || top.kind == tokenLeftBracket {
 			return nil, errors.New("Несовпадение скобок")
 		}
 		rpn = append(rpn, top)
@@ -90,43 +456,179 @@ func toRPN(tokens []string) ([]string, error) {
 	return rpn, nil
 }
 
-func evaluateRPN(rpn []string) (float64, error) {
-	var stack []float64
-	for _, token := range rpn {
-		switch token {
-		case "+", "-", "*", "/":
-			if len(stack) < 2 {
-				return 0, errors.New("Ошибка вычисления: недостаточно операндов")
-			}
-			b, a := stack[len(stack)-1], stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
-			switch token {
-			case "+":
-				stack = append(stack, a+b)
-			case "-":
-				stack = append(stack, a-b)
-			case "*":
-				stack = append(stack, a*b)
-			case "/":
-				if b == 0 {
-					return 0, errors.New("Деление на ноль")
-				}
-				stack = append(stack, a/b)
+func evaluateRPN(rpn []token, e *env) (Value, error) {
+	var stack []Value
+	for _, tok := range rpn {
+		switch tok.kind {
+		case tokenOperator, tokenFunction, tokenList:
+			if len(stack) < tok.argc {
+				return Value{}, errors.New("Ошибка вычисления: недостаточно операндов")
+			}
+			args := append([]Value(nil), stack[len(stack)-tok.argc:]...)
+			stack = stack[:len(stack)-tok.argc]
+			result, err := e.apply(tok, args)
+			if err != nil {
+				return Value{}, err
 			}
+			stack = append(stack, result)
 		default:
-			num, err := strconv.ParseFloat(token, 64)
+			v, err := e.literal(tok)
 			if err != nil {
-				return 0, errors.New("Ошибка преобразования числа")
+				return Value{}, err
 			}
-			stack = append(stack, num)
+			stack = append(stack, v)
 		}
 	}
-	if len(stack) != 1 {
-		return 0, errors.New("Ошибка вычисления: неверное количество элементов на стеке")
+	if len(stack) != 1 || stack[0].kind == kindUnit {
+		return Value{}, errors.New("Ошибка вычисления: неверное количество элементов на стеке")
 	}
 	return stack[0], nil
 }
 
+// apply выполняет оператор, функцию или построение списка над аргументами.
+func (e *env) apply(tok token, args []Value) (Value, error) {
+	switch tok.kind {
+	case tokenList:
+		xs, err := flatten(args)
+		if err != nil {
+			return Value{}, err
+		}
+		return list(xs), nil
+	case tokenFunction:
+		return e.callFunction(tok.text, args)
+	}
+	if tok.text == "in" && tok.argc == 2 {
+		if args[1].kind != kindUnit {
+			return Value{}, errors.New("Не указана единица измерения после in")
+		}
+		return e.convertTo(args[0], args[1].unit)
+	}
+	op, ok := e.registry().Operator(tok.text, tok.argc == 1)
+	if !ok {
+		return Value{}, errors.New("Неизвестный оператор " + tok.text)
+	}
+	return e.callOperator(op, args)
+}
+
+// literal возвращает значение числа, даты, длительности, суммы, единицы
+// измерения или переменной.
+func (e *env) literal(tok token) (Value, error) {
+	switch tok.kind {
+	case tokenTime:
+		t, err := parseTimeLiteral(tok.text, e.location())
+		if err != nil {
+			return Value{}, err
+		}
+		return timeValue(t), nil
+	case tokenDuration:
+		d, err := parseDurationLiteral(tok.text)
+		if err != nil {
+			return Value{}, err
+		}
+		return durationValue(d), nil
+	case tokenMoney:
+		amount, currency, _ := strings.Cut(tok.text, " ")
+		d, err := parseDecimal(amount)
+		if err != nil {
+			return Value{}, err
+		}
+		return decimalValue(d, currency), nil
+	case tokenUnit:
+		return Value{kind: kindUnit, unit: tok.text}, nil
+	case tokenVariable:
+		v, ok := e.opts.Vars[tok.text]
+		if !ok {
+			v, ok = constants[tok.text]
+		}
+		if !ok {
+			return Value{}, errors.New("Недопустимый символ в выражении")
+		}
+		return v, nil
+	}
+	if e.opts.Decimal != nil {
+		d, err := parseDecimal(tok.text)
+		if err != nil {
+			return Value{}, err
+		}
+		return decimalValue(d, ""), nil
+	}
+	num, err := strconv.ParseFloat(tok.text, 64)
+	if err != nil {
+		return Value{}, errors.New("Ошибка преобразования числа")
+	}
+	v := number(num)
+	// целый литерал сохраняет точное значение для теоретико-числовых функций
+	if n, ok := new(big.Int).SetString(tok.text, 10); ok {
+		v.integer = n
+	}
+	return v, nil
+}
+
+var constants = map[string]Value{
+	"pi": number(math.Pi),
+	"e":  number(math.E),
+}
+
+var builtinOperators = []Operator{
+	{Symbol: "+", Precedence: 1, callEnv: arithmetic("+")},
+	{Symbol: "-", Precedence: 1, callEnv: arithmetic("-")},
+	{Symbol: "*", Precedence: 2, callEnv: arithmetic("*")},
+	{Symbol: "/", Precedence: 2, callEnv: arithmetic("/")},
+	{Symbol: "-", Prefix: true, Precedence: 3, callEnv: negate},
+}
+
+func arithmetic(op string) func(e *env, args []Value) (Value, error) {
+	return func(e *env, args []Value) (Value, error) {
+		return e.applyOperator(op, args[0], args[1])
+	}
+}
+
+func negate(e *env, args []Value) (Value, error) {
+	v := args[0]
+	switch v.kind {
+	case KindNumber:
+		return number(-v.num), nil
+	case KindInteger:
+		return integerValue(new(big.Int).Neg(v.integer)), nil
+	case KindDuration:
+		return durationValue(-v.duration), nil
+	case KindDecimal:
+		return decimalValue(decimal{coef: new(big.Int).Neg(v.dec.coef), scale: v.dec.scale}, v.currency), nil
+	}
+	return Value{}, errors.New("Операция - не поддерживается для типа " + v.kind.String())
+}
+
+func (e *env) applyOperator(op string, a, b Value) (Value, error) {
+	if a.kind == KindList || b.kind == KindList {
+		return Value{}, errors.New("Операция " + op + " не поддерживается для списков")
+	}
+	if isTemporal(a) || isTemporal(b) {
+		return applyTimeOperator(op, plainNumber(a), plainNumber(b))
+	}
+	if a.kind == KindDecimal || b.kind == KindDecimal {
+		return e.applyDecimalOperator(op, a, b)
+	}
+	if a.kind == KindInteger || b.kind == KindInteger {
+		if result, ok := applyIntegerOperator(op, a, b); ok {
+			return result, nil
+		}
+		a, b = plainNumber(a), plainNumber(b)
+	}
+	switch op {
+	case "+":
+		return number(a.num + b.num), nil
+	case "-":
+		return number(a.num - b.num), nil
+	case "*":
+		return number(a.num * b.num), nil
+	default:
+		if b.num == 0 {
+			return Value{}, errors.New("Деление на ноль")
+		}
+		return number(a.num / b.num), nil
+	}
+}
+
 func main() {
 	expression := " 3 + 5 * ( 2 - 4) /   2"
 	result, err := Calc(expression)
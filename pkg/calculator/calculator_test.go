@@ -4,6 +4,9 @@ package calculator
 import (
 	"testing"
 	"errors"
+	"encoding/json"
+	"math"
+	"time"
 )
 
 func TestCalc(t *testing.T) {
@@ -34,4 +37,684 @@ func TestCalc(t *testing.T) {
 			t.Errorf("Calc(%q) = %v, expected %v", test.expression, result, test.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestStatistics(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   float64
+	}{
+		{"sum(1, 2, 3)", 6},
+		{"count([1, 2, 3], 4)", 4},
+		{"mean(2, 4, 6)", 4},
+		{"median(5, 1, 3, 2)", 2.5},
+		{"mode(1, 2, 2, 3, 3)", 2},
+		{"variance(2, 4, 4, 4, 5, 5, 7, 9)", 32.0 / 7},
+		{"pvariance(2, 4, 4, 4, 5, 5, 7, 9)", 4},
+		{"pstddev([2, 4, 4, 4, 5, 5, 7, 9])", 2},
+		{"percentile([10, 20, 30, 40, 50], 95)", 48},
+		{"percentile([15, 20, 35, 40, 50], 0)", 15},
+		{"mean([1, 2], [3, 4]) * 2", 5},
+		{"sum()", 0},
+	}
+
+	for _, test := range tests {
+		result, err := Calc(test.expression)
+		if err != nil {
+			t.Errorf("Calc(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if math.Abs(result-test.expected) > 1e-9 {
+			t.Errorf("Calc(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+}
+
+func TestStatisticsErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"mean()", "Неверное количество аргументов функции mean"},
+		{"stddev(3)", "Для выборочной дисперсии нужно хотя бы два значения"},
+		{"percentile([1, 2], 101)", "Уровень процентиля должен быть от 0 до 100"},
+		{"[1, 2] + 1", "Операция + не поддерживается для списков"},
+		{"[1, 2]", "Результат не является числом"},
+		{"(1, 2)", "Запятая вне списка аргументов"},
+		{"mean(1, 2]", "Несовпадение скобок"},
+	}
+
+	for _, test := range tests {
+		_, err := Calc(test.expression)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Calc(%q) returned error: %v, expected: %v", test.expression, err, test.err)
+		}
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   float64
+	}{
+		{"normcdf(1.96)", 0.9750021048517795},
+		{"normcdf(0, 1, 2)", 0.3085375387259869},
+		{"normpdf(0)", 0.3989422804014327},
+		{"norminv(0.975)", 1.959963984540054},
+		{"norminv(0.0000001)", -5.199337582192817},
+		{"tcdf(2.228, 10)", 0.9749941},
+		{"tinv(0.975, 10)", 2.228138851986274},
+		{"tpdf(0, 1)", 1 / math.Pi},
+		{"chi2cdf(3.841458820694124, 1)", 0.95},
+		{"chi2inv(0.95, 2)", 5.991464547107979},
+		{"binompmf(3, 10, 0.5)", 0.1171875},
+		{"binomcdf(3, 10, 0.5)", 0.171875},
+		{"binominv(0.5, 10, 0.5)", 5},
+		{"poissonpmf(2, 3)", 0.22404180765538775},
+		{"poissoncdf(2, 3)", 0.42319008112684353},
+		{"poissoninv(0.5, 3)", 3},
+		{"expcdf(1, 2)", 0.8646647167633873},
+		{"expinv(0.5, 1)", math.Ln2},
+		{"unifcdf(0.25, 0, 1)", 0.25},
+		{"unifinv(0.5, 2, 4)", 3},
+	}
+
+	for _, test := range tests {
+		result, err := Calc(test.expression)
+		if err != nil {
+			t.Errorf("Calc(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if math.Abs(result-test.expected) > 1e-6 {
+			t.Errorf("Calc(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+}
+
+func TestDistributionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		code       string
+	}{
+		{"norminv(1)", CodeProbabilityRange},
+		{"normcdf(0, 0, 0)", CodeInvalidParameter},
+		{"binompmf(1, 2.5, 0.5)", CodeIntegerRequired},
+		{"binompmf(1, 2, 1.5)", CodeProbabilityRange},
+		{"tcdf(1, 0)", CodeInvalidParameter},
+		{"poissonpmf(1, 0)", CodeInvalidParameter},
+		{"unifpdf(1, 2, 2)", CodeInvalidParameter},
+		// двоичный поиск квантиля не сходится выше 2^53
+		{"poissoninv(0.5, 10000000000000000)", CodeInvalidParameter},
+		{"poissoninv(0.5, 100000000000000000000)", CodeInvalidParameter},
+		{"binominv(0.5, 100000000000000000000, 0.5)", CodeInvalidParameter},
+		{"poissoninv(0.5, 9007199254740992)", CodeNoConvergence},
+	}
+
+	for _, test := range tests {
+		_, err := Calc(test.expression)
+		var calcErr *Error
+		if !errors.As(err, &calcErr) || calcErr.Code != test.code {
+			t.Errorf("Calc(%q) returned error: %v, expected code: %v", test.expression, err, test.code)
+		}
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("нет базы часовых поясов")
+	}
+	opts := Options{Now: func() time.Time {
+		return time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	}}
+
+	tests := []struct {
+		expression string
+		opts       Options
+		expected   string
+	}{
+		{"2024-03-01 + 90d", opts, "2024-05-30T00:00:00Z"},
+		{"(2024-12-31 - 2024-01-01) in days", opts, "365"},
+		{"now() + 2h30m", opts, "2024-06-01T11:30:00Z"},
+		{"now() in Europe/Moscow", opts, "2024-06-01T12:00:00+03:00"},
+		{"2024-03-01T10:00:00+03:00 - 2024-03-01T10:00:00Z", opts, "-PT3H"},
+		{"2024-03-01 - 1w", opts, "2024-02-23T00:00:00Z"},
+		{"1h30m * 2", opts, "PT3H"},
+		{"1d / 8h", opts, "3"},
+		{"90m in hours", opts, "1.5"},
+		{"today()", Options{Location: moscow, Now: opts.Now}, "2024-06-01T00:00:00+03:00"},
+		{"2024-03-01T10:00", Options{Location: moscow}, "2024-03-01T10:00:00+03:00"},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.expression, test.opts)
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if result.String() != test.expected {
+			t.Errorf("Evaluate(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+
+	for _, expression := range []string{"2024-03-01 + 2024-03-02", "2024-03-01 * 2", "1d in parsecs", "2024-03-01 in Mars/Olympus", "5 in days"} {
+		if _, err := Evaluate(expression, opts); err == nil {
+			t.Errorf("Evaluate(%q) expected error", expression)
+		}
+	}
+}
+
+func TestValueJSON(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"1 + 2", `3`},
+		{"[1, 2.5]", `[1,2.5]`},
+		{"2024-03-01 + 36h", `"2024-03-02T12:00:00Z"`},
+		{"2h30m + 1d", `"P1DT2H30M"`},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.expression, Options{})
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		data, err := json.Marshal(result)
+		if err != nil || string(data) != test.expected {
+			t.Errorf("json.Marshal(%q) = %s, %v, expected %s", test.expression, data, err, test.expected)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	rates, err := ParseRates([]byte(`{"base": "RUB", "rates": {"USD": "90", "EUR": 100}}`))
+	if err != nil {
+		t.Fatalf("ParseRates returned error: %v", err)
+	}
+
+	tests := []struct {
+		expression string
+		opts       DecimalOptions
+		expected   string
+	}{
+		{"0.1 + 0.2", DecimalOptions{Scale: 2}, "0.30"},
+		{"1 / 3", DecimalOptions{Scale: 4}, "0.3333"},
+		{"2 / 3", DecimalOptions{Scale: 2, Rounding: RoundDown}, "0.66"},
+		{"0.125 * 1", DecimalOptions{Scale: 2, Rounding: RoundHalfEven}, "0.12"},
+		{"0.125 * 1", DecimalOptions{Scale: 2, Rounding: RoundHalfUp}, "0.13"},
+		{"0 - 0.125", DecimalOptions{Scale: 2, Rounding: RoundHalfUp}, "-0.13"},
+		{"1 / 3 * 3", DecimalOptions{Scale: 2}, "1.00"},
+		{"100 USD + 20 EUR in RUB", DecimalOptions{Scale: 2}, "11000.00 RUB"},
+		{"100 USD + 90 EUR", DecimalOptions{Scale: 2}, "200.00 USD"},
+		{"19.99 USD * 3", DecimalOptions{Scale: 2}, "59.97 USD"},
+		{"100 USD / 3", DecimalOptions{Scale: 2}, "33.33 USD"},
+		{"100 USD / 50 USD", DecimalOptions{Scale: 0}, "2"},
+	}
+
+	for _, test := range tests {
+		opts := test.opts
+		result, err := Evaluate(test.expression, Options{Decimal: &opts, Rates: rates})
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if result.String() != test.expected {
+			t.Errorf("Evaluate(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+
+	for _, expression := range []string{"100 USD + 5", "100 USD * 2 EUR", "100 USD in JPY", "1 / 0"} {
+		if _, err := Evaluate(expression, Options{Decimal: &DecimalOptions{Scale: 2}, Rates: rates}); err == nil {
+			t.Errorf("Evaluate(%q) expected error", expression)
+		}
+	}
+	if _, err := Evaluate("1 USD + 1 EUR", Options{}); err == nil {
+		t.Error("Evaluate without rates expected error")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	power := func(args []Value) (Value, error) {
+		a, _ := args[0].Float()
+		b, _ := args[1].Float()
+		return Number(math.Pow(a, b)), nil
+	}
+	mustRegister := func(err error) {
+		if err != nil {
+			t.Fatalf("registration failed: %v", err)
+		}
+	}
+	mustRegister(reg.RegisterOperator(Operator{Symbol: "**", Precedence: 4, Assoc: RightAssoc, Call: power}))
+	mustRegister(reg.RegisterOperator(Operator{Symbol: "mod", Precedence: 2, Call: func(args []Value) (Value, error) {
+		a, _ := args[0].Float()
+		b, _ := args[1].Float()
+		return Number(math.Mod(a, b)), nil
+	}}))
+	mustRegister(reg.RegisterFunction(Function{Name: "hypot", MinArgs: 2, MaxArgs: 2, Pure: true, Call: func(args []Value) (Value, error) {
+		a, _ := args[0].Float()
+		b, _ := args[1].Float()
+		return Number(math.Hypot(a, b)), nil
+	}}))
+	mustRegister(reg.Define("vat(x) = x * 0.2"))
+	mustRegister(reg.Define("gross(x, rate) = x + x * rate"))
+
+	tests := []struct {
+		expression string
+		expected   float64
+	}{
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"2 * -3", -6},
+		{"-(1 + 2) * 2", -6},
+		{"10 mod 4 + 1", 3},
+		{"hypot(3, 4)", 5},
+		{"vat(100) + gross(100, 0.1)", 130},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.expression, Options{Registry: reg})
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if num, _ := result.Float(); math.Abs(num-test.expected) > 1e-9 {
+			t.Errorf("Evaluate(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+
+	if _, err := Calc("2 ** 3"); err == nil {
+		t.Error("operators registered in a custom registry must not leak into DefaultRegistry")
+	}
+	if fn, ok := reg.Function("vat"); !ok || !fn.Pure {
+		t.Error("vat must be registered as a pure function")
+	}
+	if err := reg.Define("stamp(x) = now() + x"); err != nil {
+		t.Fatalf("Define returned error: %v", err)
+	}
+	if fn, _ := reg.Function("stamp"); fn.Pure {
+		t.Error("stamp calls now() and must not be pure")
+	}
+	if err := reg.RegisterOperator(Operator{Symbol: "(", Precedence: 1, Call: power}); err == nil {
+		t.Error("expected error for invalid operator symbol")
+	}
+
+	applied, err := reg.Apply("**", Number(2), Number(10))
+	if num, _ := applied.Float(); err != nil || num != 1024 {
+		t.Errorf("Apply(**) = %v, %v, expected 1024", applied, err)
+	}
+	applied, err = reg.Apply("vat", Number(50))
+	if num, _ := applied.Float(); err != nil || num != 10 {
+		t.Errorf("Apply(vat) = %v, %v, expected 10", applied, err)
+	}
+	if _, err := reg.Apply("/", Number(1), Number(0)); err == nil {
+		t.Error("Apply(/) expected division by zero error")
+	}
+}
+
+func TestImplicitMultiplication(t *testing.T) {
+	vars := map[string]Value{"x": Number(2), "a": Number(5), "b": Number(3), "m": Number(10), "mm": Number(4)}
+	tests := []struct {
+		expression string
+		implicit   ImplicitPrecedence
+		expected   float64
+	}{
+		{"2(3+4)", ImplicitTextbook, 14},
+		{"(a+b)(a-b)", ImplicitTextbook, 16},
+		{"2pi", ImplicitTextbook, 2 * math.Pi},
+		{"3x", ImplicitTextbook, 6},
+		{"3x mean(1, 3)", ImplicitTextbook, 12},
+		{"1/2x", ImplicitTextbook, 0.25},
+		{"1/2x", ImplicitCalculator, 1},
+		{"2x/4", ImplicitTextbook, 1},
+		{"-2x", ImplicitTextbook, -4},
+		{"2e", ImplicitTextbook, 2 * math.E},
+		// переменная с именем единицы длительности умножается через пробел,
+		// * или скобки; имя длиннее единицы — обычная переменная
+		{"3 m", ImplicitTextbook, 30},
+		{"3*m", ImplicitTextbook, 30},
+		{"3(m)", ImplicitTextbook, 30},
+		{"3mm", ImplicitTextbook, 12},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.expression, Options{Vars: vars, Implicit: test.implicit})
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if num, _ := result.Float(); math.Abs(num-test.expected) > 1e-9 {
+			t.Errorf("Evaluate(%q) = %v, expected %v", test.expression, result, test.expected)
+		}
+	}
+
+	for _, expression := range []string{"2(3+4)", "2pi", "(1+2)(3)"} {
+		_, err := Evaluate(expression, Options{Strict: true})
+		if err == nil || err.Error() != "Неявное умножение запрещено в строгом режиме" {
+			t.Errorf("Evaluate(%q) in strict mode returned %v, expected implicit multiplication error", expression, err)
+		}
+	}
+	if _, err := Evaluate("2 * (3 + 4)", Options{Strict: true}); err != nil {
+		t.Errorf("explicit multiplication must work in strict mode: %v", err)
+	}
+	// число, сразу за которым идет единица, — длительность, даже если есть
+	// переменная с таким именем
+	for _, expression := range []string{"3d", "3m", "2h30m"} {
+		if result, err := Evaluate(expression, Options{Vars: vars}); err != nil || result.Kind() != KindDuration {
+			t.Errorf("Evaluate(%q) = %v, %v, expected duration", expression, result, err)
+		}
+	}
+	if result, _ := Evaluate("3m in minutes", Options{Vars: vars}); result.String() != "3" {
+		t.Errorf("Evaluate(3m in minutes) = %v, expected 3", result)
+	}
+}
+
+func TestTable(t *testing.T) {
+	points, err := Table("1/x + 1", "x", -1, 1, 0.5)
+	if err != nil {
+		t.Fatalf("Table returned error: %v", err)
+	}
+	expected := []float64{0, -1, 0, 3, 2}
+	if len(points) != len(expected) {
+		t.Fatalf("Table returned %d points, expected %d", len(points), len(expected))
+	}
+	for i, p := range points {
+		if i == 2 {
+			if p.Err == nil || p.Err.Error() != "Деление на ноль" {
+				t.Errorf("point x=0: expected division by zero, got %v", p.Err)
+			}
+			continue
+		}
+		if p.Err != nil || math.Abs(p.Y-expected[i]) > 1e-9 {
+			t.Errorf("point x=%v = %v, %v, expected %v", p.X, p.Y, p.Err, expected[i])
+		}
+	}
+
+	data, err := json.Marshal(points[1:3])
+	if err != nil || string(data) != `[{"x":-0.5,"y":-1},{"error":"Деление на ноль","x":0,"y":null}]` {
+		t.Errorf("json.Marshal(points) = %s, %v", data, err)
+	}
+
+	points, err = TableWithOptions("2x + a", "x", 0, 0.3, 0.1, Options{Vars: map[string]Value{"a": Number(1)}})
+	if err != nil || len(points) != 4 || math.Abs(points[3].Y-1.6) > 1e-9 {
+		t.Errorf("TableWithOptions = %v, %v", points, err)
+	}
+
+	for _, args := range [][3]float64{{0, 1, 0}, {1, 0, 0.1}, {0, 1e6, 1}} {
+		if _, err := Table("x", "x", args[0], args[1], args[2]); err == nil {
+			t.Errorf("Table(%v) expected error", args)
+		}
+	}
+}
+
+func TestNumberTheory(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"gcd(48, 180, 30)", "6"},
+		{"lcm(4, 6, 10)", "60"},
+		{"nCr(50, 25)", "126410606437752"},
+		{"nCr(100, 50)", "100891344545564193334812497256"},
+		{"nCr(5, 7)", "0"},
+		{"nPr(10, 3)", "720"},
+		{"isprime(2147483647)", "1"},
+		{"isprime(561)", "0"},
+		{"nextprime(100)", "101"},
+		{"factor(360)", "[2, 2, 2, 3, 3, 5]"},
+		{"factor(600851475143)", "[71, 839, 1471, 6857]"},
+		{"factor(1000000016000000063)", "[1000000007, 1000000009]"},
+		{"factor(18446744073709551615)", "[3, 5, 17, 257, 641, 65537, 6700417]"},
+		{"modpow(4, 13, 497)", "445"},
+		{"modpow(123456789012345678901234567890, 65537, 1000000000000000000000007)", "147663567752663029077200"},
+		{"modpow(3, -1, 7)", "5"},
+		{"modinv(17, 3120)", "2753"},
+		{"nCr(100, 50) - nCr(100, 50) + 1", "1"},
+		{"gcd(12, 18) * 2", "12"},
+		{"gcd(12, 18) / 4", "1.5"},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.expression, Options{})
+		if err != nil {
+			t.Errorf("Evaluate(%q) returned error: %v", test.expression, err)
+			continue
+		}
+		if result.String() != test.expected {
+			t.Errorf("Evaluate(%q) = %s, expected %s", test.expression, result, test.expected)
+		}
+	}
+
+	errorTests := []struct {
+		expression string
+		code       string
+	}{
+		{"gcd(2.5, 5)", CodeIntegerRequired},
+		{"modinv(6, 9)", CodeInvalidParameter},
+		{"modpow(2, 3, 0)", CodeInvalidParameter},
+		{"factor(0)", CodeInvalidParameter},
+		{"nCr(-1, 0)", CodeInvalidParameter},
+		// 2^64 и 2^512 — на бит длиннее допустимого
+		{"factor(18446744073709551616)", CodeInvalidParameter},
+		{"nextprime(13407807929942597099574024998205846127479365820592393377723561443721764030073546976801874298166903427690031858186486050853753882811946569946433649006084096)", CodeInvalidParameter},
+	}
+	for _, test := range errorTests {
+		_, err := Evaluate(test.expression, Options{})
+		var calcErr *Error
+		if !errors.As(err, &calcErr) || calcErr.Code != test.code {
+			t.Errorf("Evaluate(%q) returned %v, expected code %s", test.expression, err, test.code)
+		}
+	}
+
+	result, _ := Evaluate("factor(12)", Options{})
+	if data, err := json.Marshal(result); err != nil || string(data) != "[2,2,3]" {
+		t.Errorf("json.Marshal(factor(12)) = %s, %v", data, err)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	seed := int64(42)
+	reg := NewRegistry()
+	if err := reg.Define("noisy(x) = x + randn(0, 0.1)"); err != nil {
+		t.Fatalf("Define returned error: %v", err)
+	}
+	expression := "rand() + randint(1, 6) + randn(10, 2) + choice(1, [2, 3]) + noisy(1) + noisy(1)"
+
+	first, err := Evaluate(expression, Options{Seed: &seed, Registry: reg})
+	if err != nil {
+		t.Fatalf("Evaluate returned error: %v", err)
+	}
+	second, _ := Evaluate(expression, Options{Seed: &seed, Registry: reg})
+	if first.String() != second.String() {
+		t.Errorf("same seed gave different results: %v and %v", first, second)
+	}
+	other := int64(7)
+	if third, _ := Evaluate(expression, Options{Seed: &other, Registry: reg}); third.String() == first.String() {
+		t.Errorf("different seeds gave the same result %v", third)
+	}
+	if noisy, _ := reg.Function("noisy"); noisy.Pure {
+		t.Error("functions calling randn must not be pure")
+	}
+
+	// два вызова пользовательской функции продолжают одну последовательность
+	pair, _ := Evaluate("noisy(0) - noisy(0)", Options{Seed: &seed, Registry: reg})
+	if num, _ := pair.Float(); num == 0 {
+		t.Error("repeated calls of a random function returned the same value")
+	}
+
+	for i := int64(0); i < 100; i++ {
+		v, err := Evaluate("randint(-2, 2)", Options{Seed: &i})
+		if num, _ := v.Float(); err != nil || num < -2 || num > 2 || num != math.Trunc(num) {
+			t.Fatalf("randint(-2, 2) = %v, %v", v, err)
+		}
+	}
+
+	for _, expression := range []string{"randint(3, 1)", "randint(1.5, 3)", "randn(0, -1)", "choice([])"} {
+		if _, err := Evaluate(expression, Options{Seed: &seed}); err == nil {
+			t.Errorf("Evaluate(%q) expected error", expression)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	g, err := Plan("(1 + 2) * (3 + 4) - mean(1, 2 * 3)")
+	if err != nil {
+		t.Fatalf("Plan returned error: %v", err)
+	}
+	if len(g.Nodes) != 6 {
+		t.Fatalf("expected 6 nodes, got %d", len(g.Nodes))
+	}
+	levels := map[string]int{}
+	for _, node := range g.Nodes {
+		levels[node.Operation] = node.Level
+	}
+	if levels["+"] != 0 || levels["mean"] != 1 || levels["-"] != 2 {
+		t.Errorf("unexpected node levels: %v", levels)
+	}
+	if g.Result.Literal || g.Nodes[g.Result.Node].Operation != "-" {
+		t.Errorf("root must be the subtraction node, got %+v", g.Result)
+	}
+	position := map[int]int{}
+	for i, id := range g.Order {
+		position[id] = i
+	}
+	for _, node := range g.Nodes {
+		for _, dep := range node.DependsOn {
+			if position[dep] >= position[node.ID] {
+				t.Errorf("node %d is ordered before its dependency %d", node.ID, dep)
+			}
+		}
+	}
+	if dependents := g.Dependents(); len(dependents[g.Result.Node]) != 0 {
+		t.Errorf("root must have no dependents, got %v", dependents[g.Result.Node])
+	}
+
+	for _, expression := range []string{
+		"3 + 5 * (2 - 4) / 2",
+		"-(1 + 2) * -3",
+		"stddev([1, 2 * 2, 9])",
+		"(2024-12-31 - 2024-01-01) in days",
+		"2(3+4) + 2pi",
+		"7",
+	} {
+		g, err := Plan(expression)
+		if err != nil {
+			t.Errorf("Plan(%q) returned error: %v", expression, err)
+			continue
+		}
+		planned, err := g.Execute(Options{})
+		expected, _ := Evaluate(expression, Options{})
+		if err != nil || planned.String() != expected.String() {
+			t.Errorf("Plan(%q).Execute() = %v, %v, expected %v", expression, planned, err, expected)
+		}
+	}
+
+	g, _ = Plan("-2 * 3")
+	data, err := json.Marshal(g)
+	expected := `{"nodes":[{"id":0,"operation":"*","operands":[{"literal":-2},{"literal":3}],"depends_on":[],"level":0,"pure":true}],"order":[0],"result":{"node":0}}`
+	if err != nil || string(data) != expected {
+		t.Errorf("json.Marshal(Plan) = %s, %v", data, err)
+	}
+	if _, err := Plan("2 +"); err == nil {
+		t.Error("expected error for incomplete expression")
+	}
+}
+
+func TestCache(t *testing.T) {
+	// одинаковые подвыражения становятся одним узлом
+	g, err := Plan("(1 + 2) * (2+1)")
+	if err != nil || len(g.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %v, %v", g, err)
+	}
+	if deps := g.Nodes[g.Result.Node].DependsOn; len(deps) != 1 {
+		t.Errorf("expected a single dependency, got %v", deps)
+	}
+	if result, err := g.Execute(Options{}); err != nil || result.String() != "9" {
+		t.Errorf("Execute() = %v, %v, expected 9", result, err)
+	}
+
+	key := func(expression string) string {
+		g, err := Plan(expression)
+		if err != nil {
+			t.Fatalf("Plan(%q) returned error: %v", expression, err)
+		}
+		return g.Key()
+	}
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"(3 * 4) + 1", "1+(4*3)", true},
+		{"mean(1, 2 * 3)", "mean( 1,3*2 )", true},
+		{"1 - 2", "2 - 1", false},
+		{"6 / 3", "3 / 6", false},
+		{"1 + 2", "1 + 2.5", false},
+	}
+	for _, test := range tests {
+		if equal := key(test.a) == key(test.b); equal != test.equal {
+			t.Errorf("Key(%q) == Key(%q) is %v, expected %v", test.a, test.b, equal, test.equal)
+		}
+	}
+	if k := key("rand() + 1"); k != "" {
+		t.Errorf("expression with rand() must have no key, got %q", k)
+	}
+	if g, _ := Plan("rand() + rand()"); len(g.Nodes) != 3 {
+		t.Errorf("rand() calls must not be merged, got %d nodes", len(g.Nodes))
+	}
+
+	cache := NewCache(2, time.Hour)
+	for _, expression := range []string{"1 + 2", "2+1", "1 + 2"} {
+		if result, err := Evaluate(expression, Options{Cache: cache}); err != nil || result.String() != "3" {
+			t.Errorf("Evaluate(%q) = %v, %v, expected 3", expression, result, err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	seed := int64(1)
+	Evaluate("rand()", Options{Cache: cache, Seed: &seed})
+	Evaluate("2 +", Options{Cache: cache})
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Errorf("rand() and errors must not be cached, got %d entries", stats.Entries)
+	}
+	// decimal-режим вычисляет то же выражение иначе
+	decimal := DecimalOptions{Scale: 2}
+	if result, _ := Evaluate("1 / 3", Options{Cache: cache, Decimal: &decimal}); result.String() != "0.33" {
+		t.Errorf("decimal result must not come from the float cache, got %v", result)
+	}
+
+	// целые больше 2^53 различаются точным значением
+	exact := "nextprime(9007199254740997) - nextprime(9007199254740996)"
+	if g, _ := Plan(exact); len(g.Nodes) != 3 {
+		t.Errorf("Plan(%q): distinct integer literals must not be merged, got %d nodes", exact, len(g.Nodes))
+	}
+	if result, err := Evaluate(exact, Options{Cache: NewCache(10, time.Hour)}); err != nil || result.String() != "36" {
+		t.Errorf("Evaluate(%q) = %v, %v, expected 36", exact, result, err)
+	}
+	Evaluate("nextprime(9007199254740996)", Options{Cache: cache})
+	if result, _ := Evaluate("nextprime(9007199254740997)", Options{Cache: cache}); result.String() != "9007199254741033" {
+		t.Errorf("nextprime(9007199254740997) must not come from the cache, got %v", result)
+	}
+
+	cache.Put("a", Number(1))
+	cache.Put("b", Number(2))
+	cache.Get("a")
+	cache.Put("c", Number(3))
+	if _, ok := cache.Get("b"); ok {
+		t.Error("least recently used entry must be evicted")
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Capacity != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	expiring := NewCache(10, time.Millisecond)
+	expiring.Put("a", Number(1))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.Get("a"); ok {
+		t.Error("expired entry must not be returned")
+	}
+	if disabled := NewCache(0, time.Hour); disabled != nil {
+		t.Error("zero size must disable the cache")
+	}
+}
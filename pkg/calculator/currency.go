@@ -0,0 +1,155 @@
+package calculator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+)
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Rates — курсы валют: сколько единиц базовой валюты стоит единица каждой валюты.
+type Rates struct {
+	Base  string
+	rates map[string]decimal
+}
+
+// ParseRates разбирает курсы валют в формате
+// {"base": "RUB", "rates": {"USD": "92.50", "EUR": 100.1}}.
+func ParseRates(data []byte) (*Rates, error) {
+	var file struct {
+		Base  string                 `json:"base"`
+		Rates map[string]json.Number `json:"rates"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("Неверный формат файла курсов: %v", err)
+	}
+	if !currencyCode.MatchString(file.Base) {
+		return nil, errors.New("Неверный формат файла курсов: не указана базовая валюта")
+	}
+
+	rates := &Rates{Base: file.Base, rates: map[string]decimal{}}
+	rates.rates[file.Base] = decimal{coef: bigTen, scale: 1}
+	for code, rate := range file.Rates {
+		if !currencyCode.MatchString(code) {
+			return nil, fmt.Errorf("Неверный код валюты %s", code)
+		}
+		d, err := parseDecimal(rate.String())
+		if err != nil || d.sign() <= 0 {
+			return nil, fmt.Errorf("Неверный курс валюты %s", code)
+		}
+		rates.rates[code] = d
+	}
+	return rates, nil
+}
+
+// LoadRates читает курсы валют из файла.
+func LoadRates(path string) (*Rates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRates(data)
+}
+
+// convert пересчитывает сумму из одной валюты в другую через базовую.
+func (r *Rates) convert(amount decimal, from, to string, scale int) (decimal, error) {
+	if from == to {
+		return amount, nil
+	}
+	if r == nil {
+		return decimal{}, errors.New("Курсы валют не загружены")
+	}
+	fromRate, ok := r.rates[from]
+	if !ok {
+		return decimal{}, fmt.Errorf("Неизвестная валюта %s", from)
+	}
+	toRate, ok := r.rates[to]
+	if !ok {
+		return decimal{}, fmt.Errorf("Неизвестная валюта %s", to)
+	}
+	return amount.mul(fromRate).quo(toRate, scale+guardDigits, RoundHalfEven)
+}
+
+// applyDecimalOperator выполняет точную арифметику над десятичными числами
+// и денежными суммами. Суммы в разных валютах приводятся к валюте левого операнда.
+func (e *env) applyDecimalOperator(op string, a, b Value) (Value, error) {
+	x, err := e.toDecimal(a)
+	if err != nil {
+		return Value{}, err
+	}
+	y, err := e.toDecimal(b)
+	if err != nil {
+		return Value{}, err
+	}
+	switch op {
+	case "+", "-":
+		currency := a.currency
+		switch {
+		case a.currency == "" && b.currency != "" || a.currency != "" && b.currency == "":
+			return Value{}, errors.New("Нельзя складывать сумму в валюте с числом без валюты")
+		case a.currency != b.currency:
+			y, err = e.opts.Rates.convert(y, b.currency, a.currency, e.decimal().Scale)
+			if err != nil {
+				return Value{}, err
+			}
+		}
+		if op == "+" {
+			return decimalValue(x.add(y), currency), nil
+		}
+		return decimalValue(x.sub(y), currency), nil
+	case "*":
+		if a.currency != "" && b.currency != "" {
+			return Value{}, errors.New("Нельзя перемножать денежные суммы")
+		}
+		return decimalValue(x.mul(y), a.currency+b.currency), nil
+	default:
+		currency := a.currency
+		if b.currency != "" {
+			if a.currency == "" {
+				return Value{}, errors.New("Нельзя делить число на денежную сумму")
+			}
+			// отношение сумм — безразмерное число
+			currency = ""
+			y, err = e.opts.Rates.convert(y, b.currency, a.currency, e.decimal().Scale)
+			if err != nil {
+				return Value{}, err
+			}
+		}
+		q, err := x.quo(y, e.decimal().Scale+guardDigits, RoundHalfEven)
+		if err != nil {
+			return Value{}, err
+		}
+		return decimalValue(q, currency), nil
+	}
+}
+
+func (e *env) toDecimal(v Value) (decimal, error) {
+	switch v.kind {
+	case KindDecimal:
+		return v.dec, nil
+	case KindNumber:
+		return decimalFromFloat(v.num)
+	case KindInteger:
+		return decimal{coef: new(big.Int).Set(v.integer)}, nil
+	}
+	return decimal{}, fmt.Errorf("Значение типа %s нельзя использовать в десятичной арифметике", v.kind)
+}
+
+// convertCurrency реализует оператор in для денежных сумм.
+func (e *env) convertCurrency(v Value, currency string) (Value, error) {
+	if v.kind != KindDecimal || v.currency == "" {
+		return Value{}, fmt.Errorf("Значение типа %s нельзя перевести в валюту %s", v.kind, currency)
+	}
+	d, err := e.opts.Rates.convert(v.dec, v.currency, currency, e.decimal().Scale)
+	if err != nil {
+		return Value{}, err
+	}
+	return decimalValue(d, currency), nil
+}
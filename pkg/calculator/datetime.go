@@ -0,0 +1,176 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	dateLiteral     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2})?)?`)
+	durationLiteral = regexp.MustCompile(`^(\d+(\.\d+)?(ms|w|d|h|m|s))+`)
+	durationPart    = regexp.MustCompile(`(\d+(?:\.\d+)?)(ms|w|d|h|m|s)`)
+)
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// conversionUnits — единицы, в которых можно выразить длительность через in.
+var conversionUnits = map[string]time.Duration{
+	"milliseconds": time.Millisecond,
+	"seconds":      time.Second,
+	"minutes":      time.Minute,
+	"hours":        time.Hour,
+	"days":         24 * time.Hour,
+	"weeks":        7 * 24 * time.Hour,
+}
+
+// parseTimeLiteral разбирает дату вида 2024-03-01 или 2024-03-01T10:30:00+03:00.
+// Дата без смещения относится к часовому поясу loc.
+func parseTimeLiteral(s string, loc *time.Location) (time.Time, error) {
+	layouts := []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04Z07:00"}
+	if !strings.ContainsAny(s[10:], "Z+-") {
+		layouts = []string{"2006-01-02", "2006-01-02T15:04:05", "2006-01-02T15:04"}
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Неверная дата %s", s)
+}
+
+// parseDurationLiteral разбирает длительность вида 90d или 2h30m.
+func parseDurationLiteral(s string) (time.Duration, error) {
+	var total float64
+	for _, part := range durationPart.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.ParseFloat(part[1], 64)
+		if err != nil {
+			return 0, errors.New("Ошибка преобразования числа")
+		}
+		total += n * float64(durationUnits[part[2]])
+	}
+	if total > math.MaxInt64 {
+		return 0, errors.New("Слишком большая длительность")
+	}
+	return time.Duration(total), nil
+}
+
+// formatISODuration форматирует длительность по ISO-8601, например P90DT2H30M.
+func formatISODuration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	if d < 0 {
+		b.WriteByte('-')
+		d = -d
+	}
+	b.WriteByte('P')
+	day := 24 * time.Hour
+	if days := d / day; days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+		d -= days * day
+	}
+	if d == 0 {
+		return b.String()
+	}
+	b.WriteByte('T')
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		d -= h * time.Hour
+	}
+	if m := d / time.Minute; m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		d -= m * time.Minute
+	}
+	if d > 0 {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S")
+	}
+	return b.String()
+}
+
+// convertTo реализует оператор in: длительность выражается числом в
+// указанных единицах, дата переводится в другой часовой пояс, денежная
+// сумма — в другую валюту.
+func (e *env) convertTo(v Value, unit string) (Value, error) {
+	switch v.kind {
+	case KindDecimal:
+		return e.convertCurrency(v, unit)
+	case KindDuration:
+		size, ok := conversionUnits[unit]
+		if !ok {
+			return Value{}, fmt.Errorf("Неизвестная единица измерения %s", unit)
+		}
+		return number(float64(v.duration) / float64(size)), nil
+	case KindTime:
+		loc, err := time.LoadLocation(unit)
+		if err != nil {
+			return Value{}, fmt.Errorf("Неизвестный часовой пояс %s", unit)
+		}
+		return timeValue(v.time.In(loc)), nil
+	default:
+		return Value{}, fmt.Errorf("Значение типа %s нельзя преобразовать в %s", v.kind, unit)
+	}
+}
+
+// applyTimeOperator выполняет арифметику над датами и длительностями.
+func applyTimeOperator(op string, a, b Value) (Value, error) {
+	switch {
+	case a.kind == KindTime && b.kind == KindTime && op == "-":
+		return durationValue(a.time.Sub(b.time)), nil
+	case a.kind == KindTime && b.kind == KindDuration && (op == "+" || op == "-"):
+		if op == "-" {
+			return timeValue(a.time.Add(-b.duration)), nil
+		}
+		return timeValue(a.time.Add(b.duration)), nil
+	case a.kind == KindDuration && b.kind == KindTime && op == "+":
+		return timeValue(b.time.Add(a.duration)), nil
+	case a.kind == KindDuration && b.kind == KindDuration:
+		switch op {
+		case "+":
+			return durationValue(a.duration + b.duration), nil
+		case "-":
+			return durationValue(a.duration - b.duration), nil
+		case "/":
+			if b.duration == 0 {
+				return Value{}, errors.New("Деление на ноль")
+			}
+			return number(float64(a.duration) / float64(b.duration)), nil
+		}
+	case a.kind == KindDuration && b.kind == KindNumber && (op == "*" || op == "/"):
+		if op == "/" {
+			if b.num == 0 {
+				return Value{}, errors.New("Деление на ноль")
+			}
+			return durationValue(time.Duration(float64(a.duration) / b.num)), nil
+		}
+		return durationValue(time.Duration(float64(a.duration) * b.num)), nil
+	case a.kind == KindNumber && b.kind == KindDuration && op == "*":
+		return durationValue(time.Duration(a.num * float64(b.duration))), nil
+	}
+	return Value{}, fmt.Errorf("Операция %s не поддерживается для типов %s и %s", op, a.kind, b.kind)
+}
+
+func isTemporal(v Value) bool {
+	return v.kind == KindTime || v.kind == KindDuration
+}
+
+// plainNumber приводит десятичное число без валюты к float64, чтобы его
+// можно было использовать в арифметике длительностей.
+func plainNumber(v Value) Value {
+	if num, ok := v.Float(); ok {
+		return number(num)
+	}
+	return v
+}
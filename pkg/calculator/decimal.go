@@ -0,0 +1,181 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Rounding — правило округления в десятичном режиме.
+type Rounding int
+
+const (
+	// RoundHalfEven — банковское округление: половина округляется к четному.
+	RoundHalfEven Rounding = iota
+	// RoundHalfUp — половина округляется от нуля.
+	RoundHalfUp
+	// RoundDown — отбрасывание лишних знаков (к нулю).
+	RoundDown
+)
+
+// ParseRounding разбирает название правила округления: half_even, half_up или down.
+func ParseRounding(s string) (Rounding, error) {
+	switch s {
+	case "half_even", "":
+		return RoundHalfEven, nil
+	case "half_up":
+		return RoundHalfUp, nil
+	case "down":
+		return RoundDown, nil
+	}
+	return 0, fmt.Errorf("Неизвестное правило округления %s", s)
+}
+
+// DecimalOptions задает точность десятичного режима.
+type DecimalOptions struct {
+	// Scale — количество знаков после запятой в результате.
+	Scale int
+	// Rounding — правило округления результата.
+	Rounding Rounding
+}
+
+// defaultDecimal используется для денежных сумм вне десятичного режима.
+var defaultDecimal = DecimalOptions{Scale: 2, Rounding: RoundHalfEven}
+
+// guardDigits — дополнительные знаки промежуточного деления, чтобы
+// окончательное округление до Scale было корректным.
+const guardDigits = 12
+
+// decimal — десятичное число с фиксированной точкой: coef * 10^-scale.
+type decimal struct {
+	coef  *big.Int
+	scale int
+}
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+func parseDecimal(s string) (decimal, error) {
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" && fracPart == "" || strings.Contains(fracPart, ".") {
+		return decimal{}, errors.New("Ошибка преобразования числа")
+	}
+	coef, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok {
+		return decimal{}, errors.New("Ошибка преобразования числа")
+	}
+	return decimal{coef: coef, scale: len(fracPart)}, nil
+}
+
+// decimalFromFloat переводит число в десятичное по его кратчайшей
+// десятичной записи.
+func decimalFromFloat(f float64) (decimal, error) {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	neg := strings.HasPrefix(s, "-")
+	d, err := parseDecimal(strings.TrimPrefix(s, "-"))
+	if err != nil {
+		return decimal{}, errors.New("Число нельзя представить в десятичном виде")
+	}
+	if neg {
+		d.coef.Neg(d.coef)
+	}
+	return d, nil
+}
+
+func (d decimal) String() string {
+	digits := new(big.Int).Abs(d.coef).String()
+	sign := ""
+	if d.coef.Sign() < 0 {
+		sign = "-"
+	}
+	if d.scale <= 0 {
+		return sign + digits + strings.Repeat("0", -d.scale)
+	}
+	if len(digits) <= d.scale {
+		digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+}
+
+func (d decimal) float() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+func (d decimal) sign() int {
+	return d.coef.Sign()
+}
+
+// rescale приводит оба числа к общему масштабу.
+func rescale(a, b decimal) (*big.Int, *big.Int, int) {
+	switch {
+	case a.scale > b.scale:
+		return a.coef, new(big.Int).Mul(b.coef, pow10(a.scale-b.scale)), a.scale
+	case a.scale < b.scale:
+		return new(big.Int).Mul(a.coef, pow10(b.scale-a.scale)), b.coef, b.scale
+	}
+	return a.coef, b.coef, a.scale
+}
+
+func (d decimal) add(e decimal) decimal {
+	a, b, scale := rescale(d, e)
+	return decimal{coef: new(big.Int).Add(a, b), scale: scale}
+}
+
+func (d decimal) sub(e decimal) decimal {
+	a, b, scale := rescale(d, e)
+	return decimal{coef: new(big.Int).Sub(a, b), scale: scale}
+}
+
+func (d decimal) mul(e decimal) decimal {
+	return decimal{coef: new(big.Int).Mul(d.coef, e.coef), scale: d.scale + e.scale}
+}
+
+// quo делит с точностью scale знаков и округлением mode.
+func (d decimal) quo(e decimal, scale int, mode Rounding) (decimal, error) {
+	if e.sign() == 0 {
+		return decimal{}, errors.New("Деление на ноль")
+	}
+	// d/e = (d.coef * 10^(scale - d.scale + e.scale) / e.coef) * 10^-scale
+	num := new(big.Int).Set(d.coef)
+	den := new(big.Int).Set(e.coef)
+	if shift := scale - d.scale + e.scale; shift >= 0 {
+		num.Mul(num, pow10(shift))
+	} else {
+		den.Mul(den, pow10(-shift))
+	}
+	return decimal{coef: divRound(num, den, mode), scale: scale}, nil
+}
+
+// round округляет число до scale знаков после запятой.
+func (d decimal) round(scale int, mode Rounding) decimal {
+	if d.scale <= scale {
+		return decimal{coef: new(big.Int).Mul(d.coef, pow10(scale-d.scale)), scale: scale}
+	}
+	return decimal{coef: divRound(d.coef, pow10(d.scale-scale), mode), scale: scale}
+}
+
+// divRound делит целые числа с округлением по правилу mode.
+func divRound(num, den *big.Int, mode Rounding) *big.Int {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 || mode == RoundDown {
+		return q
+	}
+	// сравниваем удвоенный остаток с делителем, чтобы понять, больше ли он половины
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(new(big.Int).Abs(den))
+	if cmp > 0 || cmp == 0 && (mode == RoundHalfUp || q.Bit(0) == 1) {
+		if num.Sign()*den.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
@@ -0,0 +1,404 @@
+package calculator
+
+import "math"
+
+var distributionFunctions = map[string]Function{
+	"normpdf": {MinArgs: 1, MaxArgs: 3, Pure: true, Call: numericFunc(normPDF)},
+	"normcdf": {MinArgs: 1, MaxArgs: 3, Pure: true, Call: numericFunc(normCDF)},
+	"norminv": {MinArgs: 1, MaxArgs: 3, Pure: true, Call: numericFunc(normInv)},
+
+	"tpdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(tPDF)},
+	"tcdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(tCDF)},
+	"tinv": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(tInv)},
+
+	"chi2pdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(chi2PDF)},
+	"chi2cdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(chi2CDF)},
+	"chi2inv": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(chi2Inv)},
+
+	"binompmf": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(binomPMF)},
+	"binomcdf": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(binomCDF)},
+	"binominv": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(binomInv)},
+
+	"poissonpmf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(poissonPMF)},
+	"poissoncdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(poissonCDF)},
+	"poissoninv": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(poissonInv)},
+
+	"exppdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(expPDF)},
+	"expcdf": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(expCDF)},
+	"expinv": {MinArgs: 2, MaxArgs: 2, Pure: true, Call: numericFunc(expInv)},
+
+	"unifpdf": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(unifPDF)},
+	"unifcdf": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(unifCDF)},
+	"unifinv": {MinArgs: 3, MaxArgs: 3, Pure: true, Call: numericFunc(unifInv)},
+}
+
+// normParams возвращает mu и sigma; по умолчанию — стандартное нормальное распределение.
+func normParams(args []float64) (float64, float64, error) {
+	mu, sigma := 0.0, 1.0
+	if len(args) > 1 {
+		mu = args[1]
+	}
+	if len(args) > 2 {
+		sigma = args[2]
+	}
+	if !(sigma > 0) {
+		return 0, 0, newError(CodeInvalidParameter, "Стандартное отклонение должно быть положительным")
+	}
+	return mu, sigma, nil
+}
+
+func normPDF(args []float64) (float64, error) {
+	mu, sigma, err := normParams(args)
+	if err != nil {
+		return 0, err
+	}
+	z := (args[0] - mu) / sigma
+	return math.Exp(-z*z/2) / (sigma * math.Sqrt(2*math.Pi)), nil
+}
+
+func normCDF(args []float64) (float64, error) {
+	mu, sigma, err := normParams(args)
+	if err != nil {
+		return 0, err
+	}
+	// erfc сохраняет точность в обоих хвостах распределения
+	return math.Erfc(-(args[0]-mu)/(sigma*math.Sqrt2)) / 2, nil
+}
+
+func normInv(args []float64) (float64, error) {
+	mu, sigma, err := normParams(args)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkOpenProbability(args[0]); err != nil {
+		return 0, err
+	}
+	return mu - sigma*math.Sqrt2*math.Erfcinv(2*args[0]), nil
+}
+
+func checkDegrees(df float64) error {
+	if !(df > 0) || math.IsInf(df, 0) {
+		return newError(CodeInvalidParameter, "Число степеней свободы должно быть положительным")
+	}
+	return nil
+}
+
+func tPDF(args []float64) (float64, error) {
+	t, df := args[0], args[1]
+	if err := checkDegrees(df); err != nil {
+		return 0, err
+	}
+	a, _ := math.Lgamma((df + 1) / 2)
+	b, _ := math.Lgamma(df / 2)
+	return math.Exp(a - b - math.Log(df*math.Pi)/2 - (df+1)/2*math.Log1p(t*t/df)), nil
+}
+
+func tCDF(args []float64) (float64, error) {
+	t, df := args[0], args[1]
+	if err := checkDegrees(df); err != nil {
+		return 0, err
+	}
+	tail := regIncBeta(df/(df+t*t), df/2, 0.5) / 2
+	if t > 0 {
+		return 1 - tail, nil
+	}
+	return tail, nil
+}
+
+func tInv(args []float64) (float64, error) {
+	p, df := args[0], args[1]
+	if err := checkDegrees(df); err != nil {
+		return 0, err
+	}
+	if err := checkOpenProbability(p); err != nil {
+		return 0, err
+	}
+	cdf := func(x float64) float64 {
+		v, _ := tCDF([]float64{x, df})
+		return v
+	}
+	return invertCDF(cdf, p, -1, 1, false)
+}
+
+func chi2PDF(args []float64) (float64, error) {
+	x, k := args[0], args[1]
+	if err := checkDegrees(k); err != nil {
+		return 0, err
+	}
+	if x < 0 {
+		return 0, nil
+	}
+	if x == 0 {
+		switch {
+		case k < 2:
+			return math.Inf(1), nil
+		case k == 2:
+			return 0.5, nil
+		default:
+			return 0, nil
+		}
+	}
+	lg, _ := math.Lgamma(k / 2)
+	return math.Exp((k/2-1)*math.Log(x) - x/2 - k/2*math.Ln2 - lg), nil
+}
+
+func chi2CDF(args []float64) (float64, error) {
+	x, k := args[0], args[1]
+	if err := checkDegrees(k); err != nil {
+		return 0, err
+	}
+	return regLowerGamma(k/2, x/2), nil
+}
+
+func chi2Inv(args []float64) (float64, error) {
+	p, k := args[0], args[1]
+	if err := checkDegrees(k); err != nil {
+		return 0, err
+	}
+	if err := checkHalfOpenProbability(p); err != nil {
+		return 0, err
+	}
+	cdf := func(x float64) float64 { return regLowerGamma(k/2, x/2) }
+	return invertCDF(cdf, p, 0, k+1, true)
+}
+
+func binomParams(n, p float64) error {
+	if err := checkNonNegativeInteger(n, "Число испытаний"); err != nil {
+		return err
+	}
+	return checkProbability(p)
+}
+
+func binomPMF(args []float64) (float64, error) {
+	k, n, p := args[0], args[1], args[2]
+	if err := binomParams(n, p); err != nil {
+		return 0, err
+	}
+	if k != math.Floor(k) || k < 0 || k > n {
+		return 0, nil
+	}
+	switch {
+	case p == 0:
+		return boolToFloat(k == 0), nil
+	case p == 1:
+		return boolToFloat(k == n), nil
+	}
+	return math.Exp(lchoose(n, k) + k*math.Log(p) + (n-k)*math.Log1p(-p)), nil
+}
+
+func binomCDF(args []float64) (float64, error) {
+	k, n, p := math.Floor(args[0]), args[1], args[2]
+	if err := binomParams(n, p); err != nil {
+		return 0, err
+	}
+	switch {
+	case k < 0:
+		return 0, nil
+	case k >= n:
+		return 1, nil
+	}
+	return regIncBeta(1-p, n-k, k+1), nil
+}
+
+func binomInv(args []float64) (float64, error) {
+	q, n, p := args[0], args[1], args[2]
+	if err := binomParams(n, p); err != nil {
+		return 0, err
+	}
+	if err := checkSearchBound(n, "Число испытаний"); err != nil {
+		return 0, err
+	}
+	if err := checkProbability(q); err != nil {
+		return 0, err
+	}
+	// наименьшее k, при котором P(X <= k) >= q
+	lo, hi := 0.0, n
+	for lo < hi {
+		mid := math.Floor((lo + hi) / 2)
+		if c, _ := binomCDF([]float64{mid, n, p}); c >= q {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+func checkRate(lambda float64) error {
+	if !(lambda > 0) || math.IsInf(lambda, 0) {
+		return newError(CodeInvalidParameter, "Интенсивность должна быть положительной")
+	}
+	return nil
+}
+
+func poissonPMF(args []float64) (float64, error) {
+	k, lambda := args[0], args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if k != math.Floor(k) || k < 0 {
+		return 0, nil
+	}
+	lg, _ := math.Lgamma(k + 1)
+	return math.Exp(k*math.Log(lambda) - lambda - lg), nil
+}
+
+func poissonCDF(args []float64) (float64, error) {
+	k, lambda := math.Floor(args[0]), args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if k < 0 {
+		return 0, nil
+	}
+	return regUpperGamma(k+1, lambda), nil
+}
+
+func poissonInv(args []float64) (float64, error) {
+	q, lambda := args[0], args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if err := checkSearchBound(lambda, "Интенсивность"); err != nil {
+		return 0, err
+	}
+	if err := checkHalfOpenProbability(q); err != nil {
+		return 0, err
+	}
+	hi := math.Ceil(lambda + 10*math.Sqrt(lambda) + 10)
+	for regUpperGamma(hi+1, lambda) < q {
+		hi *= 2
+	}
+	if hi > maxSearchBound {
+		return 0, newError(CodeNoConvergence, "Квантиль распределения Пуассона вне диапазона точных целых")
+	}
+	lo := 0.0
+	for lo < hi {
+		mid := math.Floor((lo + hi) / 2)
+		if regUpperGamma(mid+1, lambda) >= q {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+func expPDF(args []float64) (float64, error) {
+	x, lambda := args[0], args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if x < 0 {
+		return 0, nil
+	}
+	return lambda * math.Exp(-lambda*x), nil
+}
+
+func expCDF(args []float64) (float64, error) {
+	x, lambda := args[0], args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if x < 0 {
+		return 0, nil
+	}
+	return -math.Expm1(-lambda * x), nil
+}
+
+func expInv(args []float64) (float64, error) {
+	p, lambda := args[0], args[1]
+	if err := checkRate(lambda); err != nil {
+		return 0, err
+	}
+	if err := checkHalfOpenProbability(p); err != nil {
+		return 0, err
+	}
+	return -math.Log1p(-p) / lambda, nil
+}
+
+func unifParams(a, b float64) error {
+	if !(a < b) || math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return newError(CodeInvalidParameter, "Нижняя граница равномерного распределения должна быть меньше верхней")
+	}
+	return nil
+}
+
+func unifPDF(args []float64) (float64, error) {
+	x, a, b := args[0], args[1], args[2]
+	if err := unifParams(a, b); err != nil {
+		return 0, err
+	}
+	if x < a || x > b {
+		return 0, nil
+	}
+	return 1 / (b - a), nil
+}
+
+func unifCDF(args []float64) (float64, error) {
+	x, a, b := args[0], args[1], args[2]
+	if err := unifParams(a, b); err != nil {
+		return 0, err
+	}
+	return math.Min(1, math.Max(0, (x-a)/(b-a))), nil
+}
+
+func unifInv(args []float64) (float64, error) {
+	p, a, b := args[0], args[1], args[2]
+	if err := unifParams(a, b); err != nil {
+		return 0, err
+	}
+	if err := checkProbability(p); err != nil {
+		return 0, err
+	}
+	return a + p*(b-a), nil
+}
+
+func checkProbability(p float64) error {
+	if !(p >= 0 && p <= 1) {
+		return newError(CodeProbabilityRange, "Вероятность должна быть в диапазоне [0, 1]")
+	}
+	return nil
+}
+
+// checkHalfOpenProbability — для распределений на [0, +inf), где квантиль
+// уровня 1 бесконечен.
+func checkHalfOpenProbability(p float64) error {
+	if !(p >= 0 && p < 1) {
+		return newError(CodeProbabilityRange, "Вероятность должна быть в диапазоне [0, 1)")
+	}
+	return nil
+}
+
+// checkOpenProbability — для распределений на всей прямой.
+func checkOpenProbability(p float64) error {
+	if !(p > 0 && p < 1) {
+		return newError(CodeProbabilityRange, "Вероятность должна быть в диапазоне (0, 1)")
+	}
+	return nil
+}
+
+// maxSearchBound — 2^53: выше него соседние целые в float64 не различаются,
+// и двоичный поиск квантиля дискретного распределения не сходится.
+const maxSearchBound = 1 << 53
+
+func checkSearchBound(x float64, name string) error {
+	if x > maxSearchBound {
+		return newError(CodeInvalidParameter, "%s не должно превышать 2^53", name)
+	}
+	return nil
+}
+
+func checkNonNegativeInteger(x float64, name string) error {
+	if x < 0 || x != math.Floor(x) || math.IsInf(x, 0) {
+		return newError(CodeIntegerRequired, "%s должно быть неотрицательным целым", name)
+	}
+	return nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package calculator
+
+import "fmt"
+
+// Коды ошибок вычисления, которые клиенты могут обрабатывать программно.
+const (
+	CodeProbabilityRange = "probability_out_of_range"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeIntegerRequired  = "integer_required"
+	CodeNoConvergence    = "no_convergence"
+)
+
+// Error — ошибка вычисления с машиночитаемым кодом.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
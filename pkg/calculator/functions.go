@@ -0,0 +1,100 @@
+package calculator
+
+import (
+	"errors"
+	"time"
+)
+
+var builtinFunctions = map[string]Function{
+	"sum":        {MinArgs: 0, MaxArgs: -1, Pure: true, Call: statFunc(sum)},
+	"count":      {MinArgs: 0, MaxArgs: -1, Pure: true, Call: statFunc(count)},
+	"mean":       {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(mean)},
+	"median":     {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(median)},
+	"mode":       {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(mode)},
+	"variance":   {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(sampleVariance)},
+	"stddev":     {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(sampleStddev)},
+	"pvariance":  {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(populationVariance)},
+	"pstddev":    {MinArgs: 1, MaxArgs: -1, Pure: true, Call: statFunc(populationStddev)},
+	"percentile": {MinArgs: 2, MaxArgs: -1, Pure: true, Call: percentileFunc},
+	"now":        {MinArgs: 0, MaxArgs: 0, callEnv: nowFunc},
+	"today":      {MinArgs: 0, MaxArgs: 0, callEnv: todayFunc},
+}
+
+// flatten раскрывает списки среди аргументов в один срез чисел.
+func flatten(args []Value) ([]float64, error) {
+	var result []float64
+	for _, arg := range args {
+		if arg.kind == KindList {
+			result = append(result, arg.list...)
+			continue
+		}
+		num, ok := arg.Float()
+		if !ok {
+			return nil, errors.New("Аргумент должен быть числом или списком")
+		}
+		result = append(result, num)
+	}
+	return result, nil
+}
+
+// statFunc адаптирует статистическую функцию над выборкой к сигнатуре function.
+func statFunc(f func(xs []float64) (float64, error)) func(args []Value) (Value, error) {
+	return func(args []Value) (Value, error) {
+		xs, err := flatten(args)
+		if err != nil {
+			return Value{}, err
+		}
+		result, err := f(xs)
+		if err != nil {
+			return Value{}, err
+		}
+		return number(result), nil
+	}
+}
+
+// numericFunc адаптирует функцию от чисел; списки в аргументах не допускаются.
+func numericFunc(f func(args []float64) (float64, error)) func(args []Value) (Value, error) {
+	return func(args []Value) (Value, error) {
+		xs := make([]float64, len(args))
+		for i, arg := range args {
+			num, ok := arg.Float()
+			if !ok {
+				return Value{}, errors.New("Аргумент функции должен быть числом")
+			}
+			xs[i] = num
+		}
+		result, err := f(xs)
+		if err != nil {
+			return Value{}, err
+		}
+		return number(result), nil
+	}
+}
+
+// percentileFunc: последний аргумент — уровень процентиля от 0 до 100,
+// остальные — выборка.
+func percentileFunc(args []Value) (Value, error) {
+	p, ok := args[len(args)-1].Float()
+	if !ok {
+		return Value{}, errors.New("Уровень процентиля должен быть числом")
+	}
+	xs, err := flatten(args[:len(args)-1])
+	if err != nil {
+		return Value{}, err
+	}
+	result, err := percentile(xs, p)
+	if err != nil {
+		return Value{}, err
+	}
+	return number(result), nil
+}
+
+func nowFunc(e *env, args []Value) (Value, error) {
+	return timeValue(e.now()), nil
+}
+
+// todayFunc возвращает начало текущих суток в часовом поясе вычисления.
+func todayFunc(e *env, args []Value) (Value, error) {
+	y, m, d := e.now().Date()
+	return timeValue(time.Date(y, m, d, 0, 0, 0, 0, e.location())), nil
+}
@@ -0,0 +1,323 @@
+package calculator
+
+import (
+	"math"
+	"math/big"
+	"sort"
+)
+
+// maxCombinatoricK ограничивает k в nCr и nPr: результат растет как n^k.
+const maxCombinatoricK = 100000
+
+// maxRhoSteps ограничивает число шагов ро-метода Полларда на одну попытку;
+// rhoBatch — через сколько шагов проверяется НОД.
+const (
+	maxRhoSteps = 1 << 20
+	rhoBatch    = 100
+)
+
+// maxFactorBits и maxNextPrimeBits ограничивают размер аргументов factor и
+// nextprime: время разложения и поиска простого растет с длиной числа.
+const (
+	maxFactorBits    = 64
+	maxNextPrimeBits = 512
+)
+
+var (
+	bigOne = big.NewInt(1)
+	bigTwo = big.NewInt(2)
+)
+
+var numberTheoryFunctions = map[string]Function{
+	"gcd":       {MinArgs: 1, MaxArgs: -1, Pure: true, exact: true, Call: integerFunc("gcd", gcdFunc)},
+	"lcm":       {MinArgs: 1, MaxArgs: -1, Pure: true, exact: true, Call: integerFunc("lcm", lcmFunc)},
+	"nCr":       {MinArgs: 2, MaxArgs: 2, Pure: true, exact: true, Call: integerFunc("nCr", nCr)},
+	"nPr":       {MinArgs: 2, MaxArgs: 2, Pure: true, exact: true, Call: integerFunc("nPr", nPr)},
+	"isprime":   {MinArgs: 1, MaxArgs: 1, Pure: true, exact: true, Call: integerFunc("isprime", isPrime)},
+	"nextprime": {MinArgs: 1, MaxArgs: 1, Pure: true, exact: true, Call: integerFunc("nextprime", nextPrime)},
+	"factor":    {MinArgs: 1, MaxArgs: 1, Pure: true, exact: true, Call: integerFunc("factor", factor)},
+	"modpow":    {MinArgs: 3, MaxArgs: 3, Pure: true, exact: true, Call: integerFunc("modpow", modPow)},
+	"modinv":    {MinArgs: 2, MaxArgs: 2, Pure: true, exact: true, Call: integerFunc("modinv", modInv)},
+}
+
+// integerFunc адаптирует функцию от точных целых; дробные аргументы
+// отклоняются с кодом CodeIntegerRequired.
+func integerFunc(name string, f func(args []*big.Int) (Value, error)) func(args []Value) (Value, error) {
+	return func(args []Value) (Value, error) {
+		ns := make([]*big.Int, len(args))
+		for i, arg := range args {
+			n, ok := exactInt(arg)
+			if !ok {
+				return Value{}, newError(CodeIntegerRequired, "Аргументы функции %s должны быть целыми числами", name)
+			}
+			ns[i] = new(big.Int).Set(n)
+		}
+		return f(ns)
+	}
+}
+
+// exactInt возвращает точное целое значение: у целых литералов и результатов
+// теоретико-числовых функций оно хранится без потерь, а обычные числа
+// принимаются, пока представимы в float64 точно.
+func exactInt(v Value) (*big.Int, bool) {
+	switch v.kind {
+	case KindInteger:
+		return v.integer, true
+	case KindNumber:
+		if v.integer != nil {
+			return v.integer, true
+		}
+		if v.num == math.Trunc(v.num) && math.Abs(v.num) <= 1<<53 {
+			return big.NewInt(int64(v.num)), true
+		}
+	case KindDecimal:
+		if v.currency != "" {
+			return nil, false
+		}
+		q, r := new(big.Int).QuoRem(v.dec.coef, pow10(v.dec.scale), new(big.Int))
+		if r.Sign() == 0 {
+			return q, true
+		}
+	}
+	return nil, false
+}
+
+// applyIntegerOperator выполняет арифметику без потери точности, если оба
+// операнда целые. Деление остается целым, только если делится нацело.
+func applyIntegerOperator(op string, a, b Value) (Value, bool) {
+	x, ok := exactInt(a)
+	if !ok {
+		return Value{}, false
+	}
+	y, ok := exactInt(b)
+	if !ok {
+		return Value{}, false
+	}
+	switch op {
+	case "+":
+		return integerValue(new(big.Int).Add(x, y)), true
+	case "-":
+		return integerValue(new(big.Int).Sub(x, y)), true
+	case "*":
+		return integerValue(new(big.Int).Mul(x, y)), true
+	}
+	if y.Sign() == 0 {
+		return Value{}, false
+	}
+	q, r := new(big.Int).QuoRem(x, y, new(big.Int))
+	if r.Sign() != 0 {
+		return Value{}, false
+	}
+	return integerValue(q), true
+}
+
+func gcdFunc(args []*big.Int) (Value, error) {
+	result := new(big.Int)
+	for _, n := range args {
+		result.GCD(nil, nil, result, new(big.Int).Abs(n))
+	}
+	return integerValue(result), nil
+}
+
+func lcmFunc(args []*big.Int) (Value, error) {
+	result := big.NewInt(1)
+	for _, n := range args {
+		n = new(big.Int).Abs(n)
+		if n.Sign() == 0 {
+			return integerValue(new(big.Int)), nil
+		}
+		g := new(big.Int).GCD(nil, nil, result, n)
+		result.Mul(result, n.Quo(n, g))
+	}
+	return integerValue(result), nil
+}
+
+// combinatoricArgs проверяет n и k; ok == false означает, что k вне [0, n]
+// и число сочетаний (размещений) равно нулю.
+func combinatoricArgs(name string, n, k *big.Int) (int64, int64, bool, error) {
+	if n.Sign() < 0 || !n.IsInt64() {
+		return 0, 0, false, newError(CodeInvalidParameter, "Аргумент n функции %s должен быть неотрицательным", name)
+	}
+	if k.Sign() < 0 || k.Cmp(n) > 0 {
+		return 0, 0, false, nil
+	}
+	return n.Int64(), k.Int64(), true, nil
+}
+
+func nCr(args []*big.Int) (Value, error) {
+	n, k, ok, err := combinatoricArgs("nCr", args[0], args[1])
+	if err != nil || !ok {
+		return integerValue(new(big.Int)), err
+	}
+	if n-k < k {
+		k = n - k
+	}
+	if k > maxCombinatoricK {
+		return Value{}, newError(CodeInvalidParameter, "Слишком большой аргумент k функции nCr: не более %d", maxCombinatoricK)
+	}
+	return integerValue(new(big.Int).Binomial(n, k)), nil
+}
+
+func nPr(args []*big.Int) (Value, error) {
+	n, k, ok, err := combinatoricArgs("nPr", args[0], args[1])
+	if err != nil || !ok {
+		return integerValue(new(big.Int)), err
+	}
+	if k > maxCombinatoricK {
+		return Value{}, newError(CodeInvalidParameter, "Слишком большой аргумент k функции nPr: не более %d", maxCombinatoricK)
+	}
+	if k == 0 {
+		return integerValue(big.NewInt(1)), nil
+	}
+	return integerValue(new(big.Int).MulRange(n-k+1, n)), nil
+}
+
+// isPrime возвращает 1 для простых чисел и 0 для остальных. Для чисел до
+// 2^64 тест Бейли — Померанса — Селфриджа точен.
+func isPrime(args []*big.Int) (Value, error) {
+	if args[0].Sign() > 0 && args[0].ProbablyPrime(20) {
+		return integerValue(big.NewInt(1)), nil
+	}
+	return integerValue(new(big.Int)), nil
+}
+
+// nextPrime возвращает наименьшее простое число, большее аргумента.
+func nextPrime(args []*big.Int) (Value, error) {
+	n := args[0]
+	if n.BitLen() > maxNextPrimeBits {
+		return Value{}, newError(CodeInvalidParameter, "Слишком большой аргумент функции nextprime: не более %d бит", maxNextPrimeBits)
+	}
+	if n.Cmp(bigTwo) < 0 {
+		return integerValue(big.NewInt(2)), nil
+	}
+	n.Add(n, bigOne)
+	if n.Bit(0) == 0 && n.Cmp(bigTwo) != 0 {
+		n.Add(n, bigOne)
+	}
+	for !n.ProbablyPrime(20) {
+		n.Add(n, bigTwo)
+	}
+	return integerValue(n), nil
+}
+
+// factor раскладывает число на простые множители в порядке возрастания,
+// например factor(360) = [2, 2, 2, 3, 3, 5].
+func factor(args []*big.Int) (Value, error) {
+	n := args[0]
+	if n.Sign() <= 0 {
+		return Value{}, newError(CodeInvalidParameter, "Разложить на множители можно только натуральное число")
+	}
+	if n.BitLen() > maxFactorBits {
+		return Value{}, newError(CodeInvalidParameter, "Слишком большой аргумент функции factor: не более %d бит", maxFactorBits)
+	}
+	var factors []*big.Int
+	// мелкие делители отделяются перебором, остальное — ро-методом
+	for p := int64(2); p < 1000 && n.Cmp(bigOne) > 0; p++ {
+		d := big.NewInt(p)
+		for new(big.Int).Rem(n, d).Sign() == 0 {
+			factors = append(factors, d)
+			n.Quo(n, d)
+		}
+	}
+	if n.Cmp(bigOne) > 0 {
+		rest, err := splitFactors(n)
+		if err != nil {
+			return Value{}, err
+		}
+		factors = append(factors, rest...)
+	}
+	sort.Slice(factors, func(i, j int) bool { return factors[i].Cmp(factors[j]) < 0 })
+	return integerList(factors), nil
+}
+
+func splitFactors(n *big.Int) ([]*big.Int, error) {
+	if n.ProbablyPrime(20) {
+		return []*big.Int{n}, nil
+	}
+	d := pollardRho(n)
+	if d == nil {
+		return nil, newError(CodeNoConvergence, "Не удалось разложить число на множители")
+	}
+	left, err := splitFactors(d)
+	if err != nil {
+		return nil, err
+	}
+	right, err := splitFactors(new(big.Int).Quo(n, d))
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// pollardRho ищет нетривиальный делитель составного n или возвращает nil.
+// НОД считается не на каждом шаге, а от произведения разностей за rhoBatch
+// шагов; если оно кратно n, пачка повторяется с НОД на каждом шаге.
+func pollardRho(n *big.Int) *big.Int {
+	diff, q, d := new(big.Int), new(big.Int), new(big.Int)
+	for c := int64(1); c <= 5; c++ {
+		inc := big.NewInt(c)
+		step := func(v *big.Int) {
+			v.Mul(v, v)
+			v.Add(v, inc)
+			v.Mod(v, n)
+		}
+		x, y := big.NewInt(2), big.NewInt(2)
+		d.SetInt64(1)
+		for i := 0; d.Cmp(bigOne) == 0 && i < maxRhoSteps; i += rhoBatch {
+			x0, y0 := new(big.Int).Set(x), new(big.Int).Set(y)
+			q.SetInt64(1)
+			for j := 0; j < rhoBatch; j++ {
+				step(x)
+				step(y)
+				step(y)
+				q.Mod(q.Mul(q, diff.Sub(x, y)), n)
+			}
+			if d.GCD(nil, nil, q, n); d.Cmp(n) == 0 {
+				x, y = x0, y0
+				d.SetInt64(1)
+				for j := 0; d.Cmp(bigOne) == 0 && j < rhoBatch; j++ {
+					step(x)
+					step(y)
+					step(y)
+					d.GCD(nil, nil, diff.Abs(diff.Sub(x, y)), n)
+				}
+			}
+		}
+		if d.Cmp(bigOne) != 0 && d.Cmp(n) != 0 {
+			return d
+		}
+	}
+	return nil
+}
+
+func checkModulus(name string, m *big.Int) error {
+	if m.Sign() <= 0 {
+		return newError(CodeInvalidParameter, "Модуль в функции %s должен быть положительным", name)
+	}
+	return nil
+}
+
+// modPow вычисляет b^e mod m; при отрицательном e используется обратный элемент.
+func modPow(args []*big.Int) (Value, error) {
+	b, e, m := args[0], args[1], args[2]
+	if err := checkModulus("modpow", m); err != nil {
+		return Value{}, err
+	}
+	result := new(big.Int).Exp(b.Mod(b, m), e, m)
+	if result == nil {
+		return Value{}, newError(CodeInvalidParameter, "Обратный элемент по модулю %s не существует", m)
+	}
+	return integerValue(result.Mod(result, m)), nil
+}
+
+func modInv(args []*big.Int) (Value, error) {
+	a, m := args[0], args[1]
+	if err := checkModulus("modinv", m); err != nil {
+		return Value{}, err
+	}
+	result := new(big.Int).ModInverse(a.Mod(a, m), m)
+	if result == nil {
+		return Value{}, newError(CodeInvalidParameter, "Обратный элемент по модулю %s не существует", m)
+	}
+	return integerValue(result), nil
+}
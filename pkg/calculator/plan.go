@@ -0,0 +1,195 @@
+package calculator
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+)
+
+// listOperation — операция узла, собирающего список из вычисленных элементов.
+const listOperation = "[]"
+
+// Operand — аргумент операции: литерал или результат другого узла.
+type Operand struct {
+	// Literal сообщает, что аргумент известен до вычисления и хранится в Value.
+	Literal bool
+	Value   Value
+	// Node — номер узла, результат которого является аргументом.
+	Node int
+}
+
+// MarshalJSON кодирует литерал как {"literal": 2}, а ссылку на узел — как {"node": 3}.
+func (o Operand) MarshalJSON() ([]byte, error) {
+	if o.Literal {
+		return json.Marshal(map[string]Value{"literal": o.Value})
+	}
+	return json.Marshal(map[string]int{"node": o.Node})
+}
+
+// Node — одна операция выражения: оператор, функция или построение списка.
+type Node struct {
+	ID int `json:"id"`
+	// Operation — символ оператора, имя функции или "[]" для списка;
+	// выполняется Registry.Apply.
+	Operation string    `json:"operation"`
+	Operands  []Operand `json:"operands"`
+	// DependsOn — узлы, результаты которых нужны этой операции.
+	DependsOn []int `json:"depends_on"`
+	// Level — длина самой длинной цепочки зависимостей; узлы одного уровня
+	// независимы и могут выполняться параллельно.
+	Level int `json:"level"`
+	// Pure сообщает, что результат зависит только от аргументов.
+	Pure bool `json:"pure"`
+}
+
+// Graph — выражение, разложенное на операции.
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	// Order — топологический порядок узлов по уровням.
+	Order []int `json:"order"`
+	// Result — значение выражения: результат корневого узла или литерал,
+	// если в выражении нет операций.
+	Result Operand `json:"result"`
+
+	// keys — канонические ключи узлов, index — узел по ключу; заполняются
+	// при разборе, чтобы одинаковые подвыражения становились одним узлом
+	keys  []string
+	index map[string]int
+}
+
+// Plan раскладывает выражение на граф операций.
+func Plan(expression string) (*Graph, error) {
+	return PlanWithOptions(expression, Options{})
+}
+
+// PlanWithOptions работает как Plan; значения переменных, даты и
+// десятичные числа разбираются по opts.
+func PlanWithOptions(expression string, opts Options) (*Graph, error) {
+	rpn, err := compile(expression, opts)
+	if err != nil {
+		return nil, err
+	}
+	e := &env{opts: opts}
+	reg := e.registry()
+
+	g := &Graph{index: map[string]int{}}
+	var stack []Operand
+	for _, tok := range rpn {
+		switch tok.kind {
+		case tokenOperator, tokenFunction, tokenList:
+			if len(stack) < tok.argc {
+				return nil, errors.New("Ошибка вычисления: недостаточно операндов")
+			}
+			operands := append([]Operand(nil), stack[len(stack)-tok.argc:]...)
+			stack = stack[:len(stack)-tok.argc]
+			stack = append(stack, g.add(e, reg, tok, operands))
+		default:
+			v, err := e.literal(tok)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, Operand{Literal: true, Value: v})
+		}
+	}
+	if len(stack) != 1 || stack[0].Literal && stack[0].Value.kind == kindUnit {
+		return nil, errors.New("Ошибка вычисления: неверное количество элементов на стеке")
+	}
+	g.Result = stack[0]
+
+	g.Order = make([]int, len(g.Nodes))
+	for i := range g.Order {
+		g.Order[i] = i
+	}
+	sort.SliceStable(g.Order, func(i, j int) bool {
+		return g.Nodes[g.Order[i]].Level < g.Nodes[g.Order[j]].Level
+	})
+	return g, nil
+}
+
+// add добавляет узел операции. Списки из одних литералов и отрицание
+// литерала вычисляются сразу и становятся литералами.
+func (g *Graph) add(e *env, reg *Registry, tok token, operands []Operand) Operand {
+	literal := true
+	for _, operand := range operands {
+		literal = literal && operand.Literal
+	}
+	if literal && (tok.kind == tokenList || tok.kind == tokenOperator && tok.argc == 1 && tok.text == "-") {
+		args := make([]Value, len(operands))
+		for i, operand := range operands {
+			args[i] = operand.Value
+		}
+		if v, err := e.apply(tok, args); err == nil {
+			return Operand{Literal: true, Value: v}
+		}
+	}
+
+	node := Node{ID: len(g.Nodes), Operation: tok.text, Operands: operands, DependsOn: []int{}, Pure: true}
+	if tok.kind == tokenList {
+		node.Operation = listOperation
+	}
+	if fn, ok := reg.Function(tok.text); ok && tok.kind == tokenFunction {
+		node.Pure = fn.Pure
+	}
+	// одинаковые чистые подвыражения вычисляются один раз
+	key := nodeKey(node, g.keys)
+	if id, ok := g.index[key]; ok && key != "" {
+		return Operand{Node: id}
+	}
+	for _, operand := range operands {
+		if operand.Literal || slices.Contains(node.DependsOn, operand.Node) {
+			continue
+		}
+		node.DependsOn = append(node.DependsOn, operand.Node)
+		if level := g.Nodes[operand.Node].Level + 1; level > node.Level {
+			node.Level = level
+		}
+	}
+	g.Nodes = append(g.Nodes, node)
+	g.keys = append(g.keys, key)
+	if key != "" {
+		g.index[key] = node.ID
+	}
+	return Operand{Node: node.ID}
+}
+
+// Dependents возвращает для каждого узла список узлов, которые от него зависят.
+func (g *Graph) Dependents() [][]int {
+	dependents := make([][]int, len(g.Nodes))
+	for _, node := range g.Nodes {
+		for _, dep := range node.DependsOn {
+			dependents[dep] = append(dependents[dep], node.ID)
+		}
+	}
+	return dependents
+}
+
+// Execute последовательно выполняет узлы в порядке Order.
+func (g *Graph) Execute(opts Options) (Value, error) {
+	e := &env{opts: opts}
+	reg := e.registry()
+	results := make([]Value, len(g.Nodes))
+	resolve := func(o Operand) Value {
+		if o.Literal {
+			return o.Value
+		}
+		return results[o.Node]
+	}
+	for _, id := range g.Order {
+		node := g.Nodes[id]
+		args := make([]Value, len(node.Operands))
+		for i, operand := range node.Operands {
+			args[i] = resolve(operand)
+		}
+		result, err := e.apply(reg.operationToken(node.Operation, len(args)), args)
+		if err != nil {
+			return Value{}, err
+		}
+		results[id] = result
+	}
+	result := resolve(g.Result)
+	if result.kind == KindDecimal {
+		result.dec = result.dec.round(e.decimal().Scale, e.decimal().Rounding)
+	}
+	return result, nil
+}
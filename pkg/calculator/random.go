@@ -0,0 +1,53 @@
+package calculator
+
+import "math"
+
+var randomFunctions = map[string]Function{
+	"rand":    {MinArgs: 0, MaxArgs: 0, callEnv: randFunc},
+	"randint": {MinArgs: 2, MaxArgs: 2, callEnv: randintFunc},
+	"randn":   {MinArgs: 0, MaxArgs: 2, callEnv: randnFunc},
+	"choice":  {MinArgs: 1, MaxArgs: -1, callEnv: choiceFunc},
+}
+
+// randFunc возвращает равномерно распределенное число из [0, 1).
+func randFunc(e *env, args []Value) (Value, error) {
+	return number(e.random().Float64()), nil
+}
+
+// randintFunc возвращает случайное целое из [a, b] включительно.
+func randintFunc(e *env, args []Value) (Value, error) {
+	a, okA := args[0].Float()
+	b, okB := args[1].Float()
+	if !okA || !okB || a != math.Trunc(a) || b != math.Trunc(b) || math.Abs(a) > 1<<53 || math.Abs(b) > 1<<53 {
+		return Value{}, newError(CodeIntegerRequired, "Границы randint должны быть целыми числами")
+	}
+	if a > b {
+		return Value{}, newError(CodeInvalidParameter, "Нижняя граница randint больше верхней")
+	}
+	return number(a + float64(e.random().Int63n(int64(b-a)+1))), nil
+}
+
+// randnFunc возвращает нормально распределенное число; по умолчанию mu = 0, sigma = 1.
+func randnFunc(e *env, args []Value) (Value, error) {
+	xs, err := flatten(args)
+	if err != nil || len(xs) != len(args) {
+		return Value{}, newError(CodeInvalidParameter, "Аргументы randn должны быть числами")
+	}
+	mu, sigma, err := normParams(append([]float64{0}, xs...))
+	if err != nil {
+		return Value{}, err
+	}
+	return number(mu + sigma*e.random().NormFloat64()), nil
+}
+
+// choiceFunc возвращает случайно выбранный аргумент; списки раскрываются.
+func choiceFunc(e *env, args []Value) (Value, error) {
+	xs, err := flatten(args)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(xs) == 0 {
+		return Value{}, errEmptySample
+	}
+	return number(xs[e.random().Intn(len(xs))]), nil
+}
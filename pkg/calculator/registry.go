@@ -0,0 +1,374 @@
+package calculator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Associativity — ассоциативность инфиксного оператора.
+type Associativity int
+
+const (
+	LeftAssoc Associativity = iota
+	RightAssoc
+)
+
+// Function описывает функцию калькулятора.
+type Function struct {
+	Name string
+	// MinArgs и MaxArgs ограничивают число аргументов; MaxArgs < 0 снимает
+	// верхнее ограничение.
+	MinArgs int
+	MaxArgs int
+	// Pure означает, что результат зависит только от аргументов, поэтому
+	// вызов можно кешировать и выполнять на любом агенте.
+	Pure bool
+	Call func(args []Value) (Value, error)
+
+	// callEnv используется встроенными функциями, которым нужно окружение вычисления
+	callEnv func(e *env, args []Value) (Value, error)
+	// exact отмечает функции, результат которых нельзя передать как float64
+	exact bool
+}
+
+// Operator описывает инфиксный (два аргумента) или префиксный (один
+// аргумент) оператор.
+type Operator struct {
+	Symbol     string
+	Prefix     bool
+	Precedence int
+	Assoc      Associativity
+	Call       func(args []Value) (Value, error)
+
+	callEnv func(e *env, args []Value) (Value, error)
+}
+
+// Registry хранит функции и операторы, доступные в выражениях.
+type Registry struct {
+	mu        sync.RWMutex
+	functions map[string]Function
+	infix     map[string]Operator
+	prefix    map[string]Operator
+}
+
+// DefaultRegistry используется, если в Options не указан другой реестр.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry создает реестр со встроенными функциями и операторами.
+func NewRegistry() *Registry {
+	r := &Registry{
+		functions: map[string]Function{},
+		infix:     map[string]Operator{},
+		prefix:    map[string]Operator{},
+	}
+	for _, group := range []map[string]Function{builtinFunctions, distributionFunctions, numberTheoryFunctions, randomFunctions} {
+		for name, fn := range group {
+			fn.Name = name
+			r.functions[name] = fn
+		}
+	}
+	for _, op := range builtinOperators {
+		if op.Prefix {
+			r.prefix[op.Symbol] = op
+		} else {
+			r.infix[op.Symbol] = op
+		}
+	}
+	return r
+}
+
+// RegisterFunction добавляет функцию в реестр по умолчанию.
+func RegisterFunction(fn Function) error {
+	return DefaultRegistry.RegisterFunction(fn)
+}
+
+// RegisterOperator добавляет оператор в реестр по умолчанию.
+func RegisterOperator(op Operator) error {
+	return DefaultRegistry.RegisterOperator(op)
+}
+
+// RegisterFunction добавляет функцию или заменяет одноименную.
+func (r *Registry) RegisterFunction(fn Function) error {
+	if !isIdentifier(fn.Name) || fn.Name == "in" {
+		return fmt.Errorf("Недопустимое имя функции %q", fn.Name)
+	}
+	if fn.Call == nil && fn.callEnv == nil {
+		return fmt.Errorf("Не задана реализация функции %s", fn.Name)
+	}
+	if fn.MinArgs < 0 || fn.MaxArgs >= 0 && fn.MaxArgs < fn.MinArgs {
+		return fmt.Errorf("Неверное количество аргументов функции %s", fn.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.functions[fn.Name] = fn
+	return nil
+}
+
+// RegisterOperator добавляет оператор или заменяет оператор с тем же
+// символом и видом (префиксный/инфиксный). Символ состоит либо только из
+// букв (например mod), либо только из знаков (например ** или %).
+func (r *Registry) RegisterOperator(op Operator) error {
+	if !isIdentifier(op.Symbol) && !isOperatorSymbol(op.Symbol) || op.Symbol == "in" {
+		return fmt.Errorf("Недопустимый символ оператора %q", op.Symbol)
+	}
+	if op.Call == nil && op.callEnv == nil {
+		return fmt.Errorf("Не задана реализация оператора %s", op.Symbol)
+	}
+	if op.Precedence < 1 {
+		return fmt.Errorf("Приоритет оператора %s должен быть положительным", op.Symbol)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op.Prefix {
+		r.prefix[op.Symbol] = op
+	} else {
+		r.infix[op.Symbol] = op
+	}
+	return nil
+}
+
+// Function возвращает описание функции по имени.
+func (r *Registry) Function(name string) (Function, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.functions[name]
+	return fn, ok
+}
+
+// Operator возвращает описание оператора.
+func (r *Registry) Operator(symbol string, prefix bool) (Operator, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if prefix {
+		op, ok := r.prefix[symbol]
+		return op, ok
+	}
+	op, ok := r.infix[symbol]
+	return op, ok
+}
+
+// Apply выполняет одну операцию: инфиксный оператор над двумя аргументами,
+// префиксный над одним или функцию над любым их числом. Используется
+// агентами для выполнения отдельных задач и узлов плана.
+func (r *Registry) Apply(operation string, args ...Value) (Value, error) {
+	return r.ApplyWithOptions(Options{}, operation, args...)
+}
+
+// ApplyWithOptions работает как Apply с параметрами opts; с opts.Seed
+// случайные функции дают воспроизводимый результат. opts.Registry
+// заменяется на r.
+func (r *Registry) ApplyWithOptions(opts Options, operation string, args ...Value) (Value, error) {
+	opts.Registry = r
+	e := &env{opts: opts}
+	return e.apply(r.operationToken(operation, len(args)), args)
+}
+
+// Operations возвращает имена функций и символы операторов реестра в
+// алфавитном порядке, без повторов.
+func (r *Registry) Operations() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := map[string]bool{}
+	for name := range r.functions {
+		seen[name] = true
+	}
+	for _, ops := range []map[string]Operator{r.infix, r.prefix} {
+		for symbol := range ops {
+			seen[symbol] = true
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for name := range seen {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// operationToken восстанавливает токен операции по имени и числу
+// аргументов: "[]" — построение списка, in — преобразование единиц.
+func (r *Registry) operationToken(operation string, argc int) token {
+	if operation == listOperation {
+		return token{kind: tokenList, text: operation, argc: argc}
+	}
+	if operation == "in" && argc == 2 {
+		return token{kind: tokenOperator, text: operation, argc: argc}
+	}
+	if argc == 1 || argc == 2 {
+		if _, ok := r.Operator(operation, argc == 1); ok {
+			return token{kind: tokenOperator, text: operation, argc: argc}
+		}
+	}
+	return token{kind: tokenFunction, text: operation, argc: argc}
+}
+
+// Distributable сообщает, что операцию можно выполнить на агенте, обменявшись
+// с ним только числами float64: это операторы и чистые функции от одного и
+// более аргументов, результат которых — обычное число.
+func (r *Registry) Distributable(operation string, argc int) bool {
+	tok := r.operationToken(operation, argc)
+	switch tok.kind {
+	case tokenOperator:
+		return operation != "in"
+	case tokenFunction:
+		fn, ok := r.Function(operation)
+		return ok && fn.Pure && !fn.exact && argc > 0
+	}
+	return false
+}
+
+// matchOperator ищет самый длинный зарегистрированный символ оператора,
+// начинающийся с позиции i.
+func (r *Registry) matchOperator(runes []rune, i int) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	best := ""
+	for _, ops := range []map[string]Operator{r.infix, r.prefix} {
+		for symbol := range ops {
+			if len(symbol) > len(best) && isOperatorSymbol(symbol) && strings.HasPrefix(string(runes[i:]), symbol) {
+				best = symbol
+			}
+		}
+	}
+	return best
+}
+
+// Define регистрирует функцию, заданную выражением, например
+// "vat(x) = x * 0.2". Функция чистая, если тело не вызывает нечистых функций.
+func (r *Registry) Define(definition string) error {
+	head, body, ok := strings.Cut(definition, "=")
+	if !ok {
+		return fmt.Errorf("Неверное определение функции %q: нет знака =", definition)
+	}
+	head = strings.TrimSpace(head)
+	open := strings.Index(head, "(")
+	if open < 0 || !strings.HasSuffix(head, ")") {
+		return fmt.Errorf("Неверное определение функции %q", definition)
+	}
+	name := strings.TrimSpace(head[:open])
+	var params []string
+	if inner := strings.TrimSpace(head[open+1 : len(head)-1]); inner != "" {
+		for _, param := range strings.Split(inner, ",") {
+			param = strings.TrimSpace(param)
+			if !isIdentifier(param) {
+				return fmt.Errorf("Недопустимое имя параметра %q", param)
+			}
+			params = append(params, param)
+		}
+	}
+
+	tokens, err := tokenize(body, r)
+	if err != nil {
+		return fmt.Errorf("Ошибка в теле функции %s: %v", name, err)
+	}
+	tokens, err = insertImplicit(tokens, Options{})
+	if err != nil {
+		return fmt.Errorf("Ошибка в теле функции %s: %v", name, err)
+	}
+	rpn, err := toRPN(tokens, r)
+	if err != nil {
+		return fmt.Errorf("Ошибка в теле функции %s: %v", name, err)
+	}
+	pure, exact := true, false
+	for _, tok := range rpn {
+		if fn, ok := r.Function(tok.text); ok && tok.kind == tokenFunction {
+			pure = pure && fn.Pure
+			exact = exact || fn.exact
+		}
+	}
+
+	return r.RegisterFunction(Function{
+		Name:    name,
+		MinArgs: len(params),
+		MaxArgs: len(params),
+		Pure:    pure,
+		exact:   exact,
+		callEnv: func(e *env, args []Value) (Value, error) {
+			vars := make(map[string]Value, len(params))
+			for i, param := range params {
+				vars[param] = args[i]
+			}
+			inner := *e
+			inner.opts.Vars = vars
+			if !pure {
+				// тело продолжает общую последовательность случайных чисел
+				inner.rng = e.random()
+			}
+			return evaluateRPN(rpn, &inner)
+		},
+	})
+}
+
+// LoadDefinitions регистрирует функции из файла: по одному определению
+// вида name(a, b) = выражение на строку; строки с # — комментарии.
+func (r *Registry) LoadDefinitions(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := r.Define(text); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (e *env) callFunction(name string, args []Value) (Value, error) {
+	fn, ok := e.registry().Function(name)
+	if !ok {
+		return Value{}, fmt.Errorf("Неизвестная функция %s", name)
+	}
+	if len(args) < fn.MinArgs || fn.MaxArgs >= 0 && len(args) > fn.MaxArgs {
+		return Value{}, fmt.Errorf("Неверное количество аргументов функции %s", name)
+	}
+	if fn.callEnv != nil {
+		return fn.callEnv(e, args)
+	}
+	return fn.Call(args)
+}
+
+func (e *env) callOperator(op Operator, args []Value) (Value, error) {
+	for _, arg := range args {
+		if arg.kind == kindUnit {
+			return Value{}, errors.New("Ошибка вычисления: недостаточно операндов")
+		}
+	}
+	if op.callEnv != nil {
+		return op.callEnv(e, args)
+	}
+	return op.Call(args)
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if !isLetter(c) && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isOperatorSymbol проверяет, что символ оператора не пересекается с
+// числами, скобками и разделителями.
+func isOperatorSymbol(s string) bool {
+	for _, c := range s {
+		if isLetter(c) || c >= '0' && c <= '9' || unicode.IsSpace(c) || strings.ContainsRune("()[],.", c) {
+			return false
+		}
+	}
+	return s != ""
+}
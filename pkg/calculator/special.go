@@ -0,0 +1,169 @@
+package calculator
+
+import "math"
+
+const (
+	specialMaxIter = 500
+	specialEps     = 1e-15
+	specialTiny    = 1e-300
+)
+
+// regIncBeta — регуляризованная неполная бета-функция I_x(a, b),
+// вычисляемая цепной дробью Лентца.
+func regIncBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log1p(-x))
+	// цепная дробь быстро сходится при x < (a+1)/(a+b+2), иначе используем симметрию
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaContinuedFraction(1-x, b, a)/b
+	}
+	return front * betaContinuedFraction(x, a, b) / a
+}
+
+func betaContinuedFraction(x, a, b float64) float64 {
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < specialTiny {
+		d = specialTiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= specialMaxIter; m++ {
+		fm := float64(m)
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < specialTiny {
+			d = specialTiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < specialTiny {
+			c = specialTiny
+		}
+		d = 1 / d
+		h *= d * c
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < specialTiny {
+			d = specialTiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < specialTiny {
+			c = specialTiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < specialEps {
+			break
+		}
+	}
+	return h
+}
+
+// regLowerGamma — регуляризованная нижняя неполная гамма-функция P(a, x).
+func regLowerGamma(a, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x < a+1 {
+		return gammaSeries(a, x)
+	}
+	return 1 - gammaContinuedFraction(a, x)
+}
+
+// regUpperGamma — регуляризованная верхняя неполная гамма-функция Q(a, x).
+func regUpperGamma(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	if x < a+1 {
+		return 1 - gammaSeries(a, x)
+	}
+	return gammaContinuedFraction(a, x)
+}
+
+func gammaSeries(a, x float64) float64 {
+	lg, _ := math.Lgamma(a)
+	ap, sum := a, 1/a
+	del := sum
+	for n := 0; n < specialMaxIter; n++ {
+		ap++
+		del *= x / ap
+		sum += del
+		if math.Abs(del) < math.Abs(sum)*specialEps {
+			break
+		}
+	}
+	return sum * math.Exp(-x+a*math.Log(x)-lg)
+}
+
+func gammaContinuedFraction(a, x float64) float64 {
+	lg, _ := math.Lgamma(a)
+	b := x + 1 - a
+	c := 1 / specialTiny
+	d := 1 / b
+	h := d
+	for i := 1; i <= specialMaxIter; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < specialTiny {
+			d = specialTiny
+		}
+		c = b + an/c
+		if math.Abs(c) < specialTiny {
+			c = specialTiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < specialEps {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+// lchoose — натуральный логарифм биномиального коэффициента C(n, k).
+func lchoose(n, k float64) float64 {
+	a, _ := math.Lgamma(n + 1)
+	b, _ := math.Lgamma(k + 1)
+	c, _ := math.Lgamma(n - k + 1)
+	return a - b - c
+}
+
+// invertCDF находит x, при котором монотонная функция распределения cdf
+// равна p. Начальный интервал [lo, hi] расширяется, пока не накроет корень.
+func invertCDF(cdf func(float64) float64, p, lo, hi float64, lowerBounded bool) (float64, error) {
+	for i := 0; cdf(hi) < p; i++ {
+		if i > 1000 {
+			return 0, newError(CodeNoConvergence, "Не удалось вычислить квантиль")
+		}
+		lo, hi = hi, hi*2+1
+	}
+	for i := 0; !lowerBounded && cdf(lo) > p; i++ {
+		if i > 1000 {
+			return 0, newError(CodeNoConvergence, "Не удалось вычислить квантиль")
+		}
+		hi, lo = lo, lo*2-1
+	}
+	for i := 0; i < 200; i++ {
+		mid := lo + (hi-lo)/2
+		if mid == lo || mid == hi {
+			break
+		}
+		if cdf(mid) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo + (hi-lo)/2, nil
+}
@@ -0,0 +1,112 @@
+package calculator
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+var errEmptySample = errors.New("Пустая выборка")
+
+func sum(xs []float64) (float64, error) {
+	var s float64
+	for _, x := range xs {
+		s += x
+	}
+	return s, nil
+}
+
+func count(xs []float64) (float64, error) {
+	return float64(len(xs)), nil
+}
+
+func mean(xs []float64) (float64, error) {
+	if len(xs) == 0 {
+		return 0, errEmptySample
+	}
+	s, _ := sum(xs)
+	return s / float64(len(xs)), nil
+}
+
+func median(xs []float64) (float64, error) {
+	return percentile(xs, 50)
+}
+
+// mode возвращает наиболее частое значение; при равенстве частот — наименьшее.
+func mode(xs []float64) (float64, error) {
+	if len(xs) == 0 {
+		return 0, errEmptySample
+	}
+	sorted := sortedCopy(xs)
+	best, bestCount := sorted[0], 0
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j] == sorted[i] {
+			j++
+		}
+		if j-i > bestCount {
+			best, bestCount = sorted[i], j-i
+		}
+		i = j
+	}
+	return best, nil
+}
+
+// squaredDeviations считает сумму квадратов отклонений от среднего
+// двухпроходным алгоритмом, устойчивым к потере точности.
+func squaredDeviations(xs []float64) float64 {
+	m, _ := mean(xs)
+	var ss, comp float64
+	for _, x := range xs {
+		d := x - m
+		ss += d * d
+		comp += d
+	}
+	return ss - comp*comp/float64(len(xs))
+}
+
+func sampleVariance(xs []float64) (float64, error) {
+	if len(xs) < 2 {
+		return 0, errors.New("Для выборочной дисперсии нужно хотя бы два значения")
+	}
+	return squaredDeviations(xs) / float64(len(xs)-1), nil
+}
+
+func sampleStddev(xs []float64) (float64, error) {
+	v, err := sampleVariance(xs)
+	return math.Sqrt(v), err
+}
+
+func populationVariance(xs []float64) (float64, error) {
+	if len(xs) == 0 {
+		return 0, errEmptySample
+	}
+	return squaredDeviations(xs) / float64(len(xs)), nil
+}
+
+func populationStddev(xs []float64) (float64, error) {
+	v, err := populationVariance(xs)
+	return math.Sqrt(v), err
+}
+
+// percentile вычисляет процентиль p (0..100) с линейной интерполяцией
+// между соседними порядковыми статистиками.
+func percentile(xs []float64, p float64) (float64, error) {
+	if len(xs) == 0 {
+		return 0, errEmptySample
+	}
+	if p < 0 || p > 100 || math.IsNaN(p) {
+		return 0, errors.New("Уровень процентиля должен быть от 0 до 100")
+	}
+	sorted := sortedCopy(xs)
+	pos := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo)), nil
+}
+
+func sortedCopy(xs []float64) []float64 {
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+	return sorted
+}
@@ -0,0 +1,89 @@
+package calculator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MaxTablePoints ограничивает число точек в таблице значений.
+const MaxTablePoints = 10000
+
+// Point — значение выражения при одном значении переменной. Если в точке
+// выражение не определено, Err содержит причину.
+type Point struct {
+	X   float64
+	Y   float64
+	Err error
+}
+
+// MarshalJSON кодирует точку как {"x": 1, "y": 2}; в точках с ошибкой
+// y равен null, а причина передается в поле error.
+func (p Point) MarshalJSON() ([]byte, error) {
+	if p.Err != nil {
+		return json.Marshal(map[string]interface{}{"x": p.X, "y": nil, "error": p.Err.Error()})
+	}
+	return json.Marshal(map[string]float64{"x": p.X, "y": p.Y})
+}
+
+// Table вычисляет выражение для значений переменной от from до to с шагом step.
+func Table(expression, variable string, from, to, step float64) ([]Point, error) {
+	return TableWithOptions(expression, variable, from, to, step, Options{})
+}
+
+// TableWithOptions работает как Table, но с параметрами вычисления. Ошибки
+// в отдельных точках (деление на ноль, выход из области определения) не
+// прерывают построение таблицы.
+func TableWithOptions(expression, variable string, from, to, step float64, opts Options) ([]Point, error) {
+	if !isIdentifier(variable) {
+		return nil, fmt.Errorf("Недопустимое имя переменной %q", variable)
+	}
+	for _, bound := range []float64{from, to, step} {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return nil, errors.New("Границы и шаг таблицы должны быть конечными числами")
+		}
+	}
+	if step <= 0 || from > to {
+		return nil, errors.New("Шаг должен быть положительным, а начало не больше конца")
+	}
+	count := math.Floor((to-from)/step+1e-9) + 1
+	if count > MaxTablePoints {
+		return nil, fmt.Errorf("Слишком много точек: не более %d", MaxTablePoints)
+	}
+
+	rpn, err := compile(expression, opts)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]Value, len(opts.Vars)+1)
+	for name, v := range opts.Vars {
+		vars[name] = v
+	}
+	opts.Vars = vars
+	e := &env{opts: opts}
+
+	points := make([]Point, 0, int(count))
+	for i := 0; i < int(count); i++ {
+		// x считается от начала, чтобы ошибка округления шага не накапливалась
+		x := from + float64(i)*step
+		vars[variable] = number(x)
+		points = append(points, e.point(rpn, x))
+	}
+	return points, nil
+}
+
+func (e *env) point(rpn []token, x float64) Point {
+	result, err := e.run(rpn)
+	if err != nil {
+		return Point{X: x, Err: err}
+	}
+	y, ok := result.Float()
+	if !ok {
+		return Point{X: x, Err: errors.New("Результат не является числом")}
+	}
+	if math.IsNaN(y) || math.IsInf(y, 0) {
+		return Point{X: x, Err: errors.New("Выражение не определено в этой точке")}
+	}
+	return Point{X: x, Y: y}
+}
@@ -0,0 +1,227 @@
+package calculator
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind — тип значения выражения.
+type Kind int
+
+const (
+	KindNumber Kind = iota
+	KindList
+	KindTime
+	KindDuration
+	KindDecimal
+	KindInteger
+
+	// kindUnit — единица измерения справа от оператора in; в результат не попадает
+	kindUnit
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNumber:
+		return "number"
+	case KindList:
+		return "list"
+	case KindTime:
+		return "time"
+	case KindDuration:
+		return "duration"
+	case KindDecimal:
+		return "decimal"
+	case KindInteger:
+		return "integer"
+	default:
+		return "unit"
+	}
+}
+
+// Value — результат вычисления выражения.
+type Value struct {
+	kind Kind
+	num  float64
+	list []float64
+	// ints — точные значения элементов списка целых чисел (результат factor)
+	ints []*big.Int
+	// integer — значение KindInteger или точное значение целого литерала
+	integer  *big.Int
+	time     time.Time
+	duration time.Duration
+	dec      decimal
+	currency string
+	unit     string
+}
+
+func number(n float64) Value {
+	return Value{kind: KindNumber, num: n}
+}
+
+func list(xs []float64) Value {
+	return Value{kind: KindList, list: xs}
+}
+
+func integerValue(n *big.Int) Value {
+	return Value{kind: KindInteger, integer: n}
+}
+
+func integerList(ns []*big.Int) Value {
+	xs := make([]float64, len(ns))
+	for i, n := range ns {
+		xs[i], _ = new(big.Float).SetInt(n).Float64()
+	}
+	return Value{kind: KindList, list: xs, ints: ns}
+}
+
+func timeValue(t time.Time) Value {
+	return Value{kind: KindTime, time: t}
+}
+
+func durationValue(d time.Duration) Value {
+	return Value{kind: KindDuration, duration: d}
+}
+
+func decimalValue(d decimal, currency string) Value {
+	return Value{kind: KindDecimal, dec: d, currency: currency}
+}
+
+// Number создает числовое значение.
+func Number(n float64) Value {
+	return number(n)
+}
+
+// List создает список чисел.
+func List(xs []float64) Value {
+	return list(xs)
+}
+
+// Integer создает точное целое значение.
+func Integer(n *big.Int) Value {
+	return integerValue(new(big.Int).Set(n))
+}
+
+// Time создает значение даты/времени.
+func Time(t time.Time) Value {
+	return timeValue(t)
+}
+
+// Duration создает значение длительности.
+func Duration(d time.Duration) Value {
+	return durationValue(d)
+}
+
+// Kind возвращает тип значения.
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// Float возвращает число, если значение числовое. Десятичные числа без
+// валюты и целые приводятся к float64.
+func (v Value) Float() (float64, bool) {
+	if v.kind == KindDecimal && v.currency == "" {
+		return v.dec.float(), true
+	}
+	if v.kind == KindInteger {
+		f, _ := new(big.Float).SetInt(v.integer).Float64()
+		return f, true
+	}
+	return v.num, v.kind == KindNumber
+}
+
+// maxExactFloat — 2^53, наибольшее целое, до которого float64 точен.
+var maxExactFloat = big.NewInt(1 << 53)
+
+// PlainFloat возвращает число, если значение — обычное число float64 без
+// потери точности: целые литералы больше 2^53 и десятичные числа не подходят.
+func (v Value) PlainFloat() (float64, bool) {
+	if v.kind != KindNumber || v.integer != nil && v.integer.CmpAbs(maxExactFloat) > 0 {
+		return 0, false
+	}
+	return v.num, true
+}
+
+// Integer возвращает точное целое, если значение — KindInteger.
+func (v Value) Integer() (*big.Int, bool) {
+	if v.kind != KindInteger {
+		return nil, false
+	}
+	return new(big.Int).Set(v.integer), true
+}
+
+// Currency возвращает код валюты денежной суммы.
+func (v Value) Currency() string {
+	return v.currency
+}
+
+// List возвращает элементы списка, если значение — список.
+func (v Value) List() ([]float64, bool) {
+	return v.list, v.kind == KindList
+}
+
+// Time возвращает момент времени, если значение — дата/время.
+func (v Value) Time() (time.Time, bool) {
+	return v.time, v.kind == KindTime
+}
+
+// Duration возвращает длительность, если значение — длительность.
+func (v Value) Duration() (time.Duration, bool) {
+	return v.duration, v.kind == KindDuration
+}
+
+// String форматирует значение: даты и длительности — в ISO-8601.
+func (v Value) String() string {
+	switch v.kind {
+	case KindNumber:
+		return formatFloat(v.num)
+	case KindList:
+		parts := make([]string, len(v.list))
+		for i, x := range v.list {
+			parts[i] = formatFloat(x)
+			if v.ints != nil {
+				parts[i] = v.ints[i].String()
+			}
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case KindTime:
+		return v.time.Format(time.RFC3339Nano)
+	case KindDuration:
+		return formatISODuration(v.duration)
+	case KindDecimal:
+		if v.currency != "" {
+			return v.dec.String() + " " + v.currency
+		}
+		return v.dec.String()
+	case KindInteger:
+		return v.integer.String()
+	default:
+		return v.unit
+	}
+}
+
+// MarshalJSON кодирует числа, целые и списки как JSON-числа, даты и
+// длительности — как строки ISO-8601, а десятичные числа — строками,
+// чтобы не терять точность.
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case KindNumber:
+		return json.Marshal(v.num)
+	case KindList:
+		if v.ints != nil {
+			return json.Marshal(v.ints)
+		}
+		return json.Marshal(v.list)
+	case KindInteger:
+		return json.Marshal(v.integer)
+	default:
+		return json.Marshal(v.String())
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
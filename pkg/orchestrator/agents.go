@@ -0,0 +1,276 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/terlyne/go-calculator/pkg/agent"
+)
+
+var errAgentNotFound = errors.New("Агент не зарегистрирован")
+
+// AgentTimeout — время без heartbeat, после которого агент считается
+// пропавшим: он удаляется из реестра, а его задачи возвращаются в очередь.
+var AgentTimeout = 30 * time.Second
+
+// throughputWindow — окно, за которое считается пропускная способность агента.
+const throughputWindow = time.Minute
+
+// AgentInfo — состояние агента в реестре.
+type AgentInfo struct {
+	agent.Registration
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	// Tasks — задачи, которые агент выполняет сейчас
+	Tasks     []agent.Task `json:"tasks"`
+	Completed int          `json:"completed"`
+	Failed    int          `json:"failed"`
+	// Throughput — число задач, выполненных за последнюю минуту
+	Throughput int `json:"throughput"`
+}
+
+type agentState struct {
+	info AgentInfo
+	// finished — моменты выполнения задач за throughputWindow
+	finished []time.Time
+}
+
+// agents — зарегистрированные агенты. Реестр хранится в памяти: после
+// перезапуска оркестратора агенты регистрируются заново.
+var agents = make(map[string]*agentState)
+
+// RegisterAgent добавляет агента в реестр или обновляет его описание. Агент
+// без ID получает новый идентификатор.
+func RegisterAgent(reg agent.Registration) AgentInfo {
+	mu.Lock()
+	defer mu.Unlock()
+	if reg.ID == "" {
+		reg.ID = newID()
+	}
+	if reg.Concurrency < 1 {
+		reg.Concurrency = 1
+	}
+	state, ok := agents[reg.ID]
+	if !ok {
+		state = &agentState{info: AgentInfo{RegisteredAt: now()}}
+		agents[reg.ID] = state
+	}
+	state.info.Registration = reg
+	state.info.LastSeen = now()
+	return state.info
+}
+
+// AgentHeartbeat отмечает, что агент на связи.
+func AgentHeartbeat(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return touchAgent(id)
+}
+
+// touchAgent обновляет время последнего контакта с агентом. Пустой ID
+// означает агента без регистрации.
+func touchAgent(id string) error {
+	if id == "" {
+		return nil
+	}
+	state, ok := agents[id]
+	if !ok {
+		return errAgentNotFound
+	}
+	state.info.LastSeen = now()
+	return nil
+}
+
+// recordFinished учитывает выполненную агентом задачу.
+func recordFinished(id string, failed bool) {
+	state, ok := agents[id]
+	if !ok {
+		return
+	}
+	if failed {
+		state.info.Failed++
+	} else {
+		state.info.Completed++
+	}
+	state.finished = append(state.finished, now())
+	state.prune()
+}
+
+// prune отбрасывает выполнения старше throughputWindow.
+func (s *agentState) prune() {
+	recent := s.finished[:0]
+	for _, t := range s.finished {
+		if now().Sub(t) <= throughputWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.finished = recent
+}
+
+// OperationModes задает режим, в котором агент должен выполнять операцию,
+// например "normcdf" → "prob"; операции без режима выполняются в agent.ModeFloat.
+var OperationModes = map[string]string{}
+
+// ParseOperationModes разбирает режимы операций вида "normcdf=prob,tcdf=prob".
+func ParseOperationModes(s string) (map[string]string, error) {
+	modes := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		operation, mode, ok := strings.Cut(part, "=")
+		if operation, mode = strings.TrimSpace(operation), strings.TrimSpace(mode); !ok || operation == "" || mode == "" {
+			return nil, fmt.Errorf("Неверный режим операции %q", part)
+		}
+		modes[operation] = mode
+	}
+	return modes, nil
+}
+
+// operationMode возвращает режим, в котором выполняется операция.
+func operationMode(operation string) string {
+	if mode, ok := OperationModes[operation]; ok {
+		return mode
+	}
+	return agent.ModeFloat
+}
+
+// agentModes возвращает режимы агента; пустой список означает agent.ModeFloat.
+func agentModes(modes []string) []string {
+	if len(modes) == 0 {
+		return []string{agent.ModeFloat}
+	}
+	return modes
+}
+
+// canRun сообщает, что агент может выполнить задачу с операцией operation:
+// он умеет эту операцию и поддерживает ее режим.
+func (info AgentInfo) canRun(operation string) bool {
+	return contains(agentModes(info.Modes), operationMode(operation)) &&
+		(len(info.Operations) == 0 || contains(info.Operations, operation))
+}
+
+// routable сообщает, что операцию может выполнить хотя бы один
+// зарегистрированный агент.
+func routable(operation string) bool {
+	for _, state := range agents {
+		if state.info.canRun(operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// EvictAgent удаляет агента из реестра и возвращает в очередь его задачи.
+func EvictAgent(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := agents[id]; !ok {
+		return errAgentNotFound
+	}
+	return evict(id)
+}
+
+func evict(id string) error {
+	delete(agents, id)
+	tasks, err := store.AgentTasks(id)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		task.Status = taskQueued
+		task.LeaseID = ""
+		task.Deadline = time.Time{}
+		task.AgentID = ""
+		if err := store.SaveTask(task); err != nil {
+			return err
+		}
+	}
+	if len(tasks) > 0 {
+		taskReady.notify()
+	}
+	return reroute()
+}
+
+// reroute завершает со статусом unroutable выражения, задачи которых после
+// удаления агента не может выполнить ни один из оставшихся.
+func reroute() error {
+	for _, j := range jobs {
+		if !active(j.expr.Status) {
+			continue
+		}
+		tasks, err := store.ListTasks(j.expr.ID)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.Status != taskDone && !routable(task.Operation) {
+				if err := j.finish(statusUnroutable, unroutableMessage(task.Operation)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func unroutableMessage(operation string) string {
+	return fmt.Sprintf("Нет агента, умеющего выполнять операцию %s в режиме %s", operation, operationMode(operation))
+}
+
+// evictSilent удаляет агентов, которые не выходили на связь дольше AgentTimeout.
+func evictSilent() error {
+	for id, state := range agents {
+		if now().Sub(state.info.LastSeen) > AgentTimeout {
+			if err := evict(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// watchAgents периодически удаляет пропавших агентов.
+func watchAgents() {
+	for range time.Tick(AgentTimeout / 2) {
+		mu.Lock()
+		evictSilent()
+		mu.Unlock()
+	}
+}
+
+// ListAgents возвращает агентов с их текущими задачами и пропускной
+// способностью, упорядоченных по времени регистрации.
+func ListAgents() ([]AgentInfo, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := evictSilent(); err != nil {
+		return nil, err
+	}
+	result := make([]AgentInfo, 0, len(agents))
+	for id, state := range agents {
+		tasks, err := store.AgentTasks(id)
+		if err != nil {
+			return nil, err
+		}
+		info := state.info
+		info.Tasks = make([]agent.Task, len(tasks))
+		for i, task := range tasks {
+			info.Tasks[i] = task.agentTask()
+		}
+		state.prune()
+		info.Throughput = len(state.finished)
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].RegisteredAt.Equal(result[j].RegisteredAt) {
+			return result[i].RegisteredAt.Before(result[j].RegisteredAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
@@ -0,0 +1,144 @@
+package orchestrator
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errBatchNotFound = errors.New("Пакет не найден")
+	errEmptyBatch    = errors.New("Пакет не содержит выражений")
+	errBatchTooLarge = errors.New("Пакет содержит слишком много выражений")
+)
+
+// MaxBatchSize — наибольшее число выражений в одном пакете.
+var MaxBatchSize = 1000
+
+// Batch — выражения, отправленные одним запросом.
+type Batch struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Size — число элементов запроса; Rejected — сколько из них не прошли
+	// проверку и не были созданы
+	Size     int `json:"size"`
+	Rejected int `json:"rejected"`
+}
+
+// BatchItem — элемент пакета.
+type BatchItem struct {
+	// Ref — ссылка клиента на элемент, возвращается в ответе и в выражении
+	Ref        string             `json:"ref,omitempty"`
+	Expression string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables,omitempty"`
+}
+
+// BatchResult — итог отправки элемента пакета: ID созданного выражения или
+// ошибка проверки.
+type BatchResult struct {
+	Ref   string `json:"ref,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchStatus — сводное состояние пакета.
+type BatchStatus struct {
+	Batch
+	// Status — pending, пока все выражения пакета ждут агентов, in_progress,
+	// пока вычисляется хотя бы одно выражение, и completed, когда все
+	// выражения завершены (успешно, с ошибкой, без подходящего агента или отменены)
+	Status string `json:"status"`
+	// Counts — число выражений пакета по статусам
+	Counts map[string]int `json:"counts"`
+}
+
+// SubmitBatch проверяет и отправляет выражения пакета под общим
+// владельцем и приоритетом sub (выражение sub не используется). Элементы
+// проверяются независимо: ошибка одного не мешает остальным. Ошибка
+// создания или запуска выражения возвращается в результате его элемента;
+// ошибку возвращает только сохранение самого пакета.
+func SubmitBatch(sub Submission, items []BatchItem) (Batch, []BatchResult, error) {
+	if len(items) == 0 {
+		return Batch{}, nil, errEmptyBatch
+	}
+	if len(items) > MaxBatchSize {
+		return Batch{}, nil, errBatchTooLarge
+	}
+	if err := sub.validate(); err != nil {
+		return Batch{}, nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	batch := Batch{ID: newID(), Owner: sub.Owner, CreatedAt: now(), Size: len(items)}
+	results := make([]BatchResult, len(items))
+	valid := make([]bool, len(items))
+	for i, item := range items {
+		results[i].Ref = item.Ref
+		if _, err := plan(Expression{Expression: item.Expression, Variables: item.Variables}); err != nil {
+			results[i].Error = err.Error()
+			batch.Rejected++
+			continue
+		}
+		valid[i] = true
+	}
+	// пакет сохраняется раньше выражений, чтобы они не остались без пакета
+	if err := store.CreateBatch(batch); err != nil {
+		return Batch{}, nil, err
+	}
+	started := make(map[int]*job, len(items))
+	for i, item := range items {
+		if !valid[i] {
+			continue
+		}
+		expr := sub
+		expr.Expression, expr.Variables, expr.Ref = item.Expression, item.Variables, item.Ref
+		j, err := createExpression(expr, batch.ID)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].ID = j.expr.ID
+		started[i] = j
+	}
+	// задачи ставятся в очередь после создания всех выражений пакета
+	for i := range items {
+		if j, ok := started[i]; ok {
+			if err := j.start(); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+	}
+	return batch, results, nil
+}
+
+// GetBatch возвращает сводное состояние пакета и его выражения.
+func GetBatch(id string) (BatchStatus, []Expression, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	batch, ok, err := store.GetBatch(id)
+	if err != nil {
+		return BatchStatus{}, nil, err
+	}
+	if !ok {
+		return BatchStatus{}, nil, errBatchNotFound
+	}
+	exprs, err := store.BatchExpressions(id)
+	if err != nil {
+		return BatchStatus{}, nil, err
+	}
+	status := BatchStatus{Batch: batch, Status: statusCompleted, Counts: map[string]int{}}
+	pending := 0
+	for _, expr := range exprs {
+		status.Counts[expr.Status]++
+		if active(expr.Status) {
+			status.Status = statusInProgress
+		}
+		if expr.Status == statusPending {
+			pending++
+		}
+	}
+	if pending > 0 && pending == len(exprs) {
+		status.Status = statusPending
+	}
+	return status, exprs, nil
+}
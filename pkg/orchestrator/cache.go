@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
+)
+
+// ResultCache хранит результаты чистых подвыражений по каноническому ключу:
+// узел, результат которого уже есть в кэше, не отдается агентам, а узел,
+// задачу для которого уже выполняют в другом выражении, ждет ее результата.
+// nil отключает и кэш, и общие задачи.
+var ResultCache *calculator.Cache
+
+// flight — задача, которую уже выполняют агенты для узла с тем же ключом в
+// другом выражении. Узлы waiters получают ее результат, не создавая своих
+// задач.
+type flight struct {
+	owner taskRef
+	// priority — приоритет выражения-владельца
+	priority int
+	waiters  []taskRef
+}
+
+var (
+	// inflight — выполняемые задачи по ключу узла
+	inflight = make(map[string]*flight)
+	// sharedTasks — сколько узлов получили результат чужой задачи
+	sharedTasks int
+)
+
+// reuse берет результат узла из кэша или присоединяет узел к уже
+// выполняемой задаче с тем же ключом, если ее приоритет не ниже приоритета
+// выражения; done ложно, если узел нужно вычислить.
+func (j *job) reuse(node int) (done bool, err error) {
+	key := j.keys[node]
+	if key == "" || ResultCache == nil {
+		return false, nil
+	}
+	if result, ok := ResultCache.Get(key); ok {
+		return true, j.resolve(node, result)
+	}
+	ref := taskRef{exprID: j.expr.ID, node: node}
+	if f, ok := inflight[key]; ok && f.owner != ref && f.priority >= j.expr.Priority {
+		f.waiters = append(f.waiters, ref)
+		sharedTasks++
+		return true, nil
+	}
+	return false, nil
+}
+
+// own делает узел владельцем задачи для его ключа.
+func (j *job) own(node int) {
+	if key := j.keys[node]; key != "" && ResultCache != nil {
+		if _, ok := inflight[key]; !ok {
+			inflight[key] = &flight{owner: taskRef{exprID: j.expr.ID, node: node}, priority: j.expr.Priority}
+		}
+	}
+}
+
+// shareResult передает результат узла кэшу и узлам других выражений, ждущим его
+// задачу.
+func (j *job) shareResult(node int, result calculator.Value) error {
+	key := j.keys[node]
+	ResultCache.Put(key, result)
+	f, ok := inflight[key]
+	if !ok || f.owner != (taskRef{exprID: j.expr.ID, node: node}) {
+		return nil
+	}
+	delete(inflight, key)
+	for _, w := range f.waiters {
+		if waiter, ok := jobs[w.exprID]; ok {
+			if err := waiter.resolve(w.node, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// release снимает выражение с владения задачами, которые ждут другие
+// выражения, и планирует их узлы заново: первый из них станет новым
+// владельцем. Вызывается, когда выражение завершилось ошибкой, отменено или
+// удалено.
+func (j *job) release() error {
+	var orphans []taskRef
+	for key, f := range inflight {
+		if f.owner.exprID == j.expr.ID {
+			delete(inflight, key)
+			orphans = append(orphans, f.waiters...)
+		}
+	}
+	for _, w := range orphans {
+		if waiter, ok := jobs[w.exprID]; ok {
+			if err := waiter.schedule(w.node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cacheStats отдает состояние кэша результатов и число узлов, получивших
+// результат чужой задачи.
+func cacheStats(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	shared := sharedTasks
+	mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"cache":        ResultCache.Stats(),
+		"shared_tasks": shared,
+	})
+}
@@ -0,0 +1,160 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+)
+
+// Типы событий.
+const (
+	// eventStatus — выражение сменило статус
+	eventStatus = "status"
+	// eventTask — вычислен очередной узел выражения
+	eventTask = "task"
+	// eventDeleted — выражение удалено
+	eventDeleted = "deleted"
+)
+
+// Event — изменение состояния выражения, отправляемое подписчикам.
+type Event struct {
+	Type       string     `json:"type"`
+	Expression Expression `json:"expression"`
+	// Task — ID вычисленного узла для событий task
+	Task     string    `json:"task,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Progress — сколько узлов выражения вычислено из общего числа.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// final сообщает, что после события состояние выражения больше не меняется.
+func (e Event) final() bool {
+	return e.Type == eventDeleted || e.Type == eventStatus && !active(e.Expression.Status)
+}
+
+// EventBuffer — сколько событий может ждать отправки медленному подписчику.
+// Переполнение отключает подписчика; переподключившись, он получит текущее
+// состояние выражения.
+var EventBuffer = 64
+
+// subscriber получает события одного выражения (exprID) или всех выражений
+// пользователя owner.
+type subscriber struct {
+	exprID string
+	owner  string
+	// anyOwner — поток всех выражений, когда пользователи не различаются
+	anyOwner bool
+	events   chan Event
+}
+
+func (s *subscriber) wants(e Event) bool {
+	if s.exprID != "" {
+		return s.exprID == e.Expression.ID
+	}
+	return s.anyOwner || s.owner == e.Expression.Owner
+}
+
+// subscribers защищен mu: события публикуются в том же порядке, в котором
+// меняется состояние.
+var subscribers = make(map[*subscriber]bool)
+
+func publish(e Event) {
+	for s := range subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// event описывает текущее состояние выражения с прогрессом вычисления.
+func (j *job) event(typ, task string) Event {
+	done := 0
+	for _, d := range j.done {
+		if d {
+			done++
+		}
+	}
+	return Event{Type: typ, Expression: j.expr, Task: task, Progress: &Progress{Done: done, Total: len(j.done)}}
+}
+
+// subscribeExpression подписывается на события выражения. Первым событием
+// подписчик получает текущее состояние выражения.
+func subscribeExpression(id string) (Expression, *subscriber, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	var current Event
+	if j, ok := jobs[id]; ok {
+		current = j.event(eventStatus, "")
+	} else {
+		expr, ok, err := store.GetExpression(id)
+		if err != nil {
+			return Expression{}, nil, err
+		}
+		if !ok {
+			return Expression{}, nil, errExpressionNotFound
+		}
+		current = Event{Type: eventStatus, Expression: expr}
+	}
+	s := subscribe(&subscriber{exprID: id})
+	s.events <- current
+	return current.Expression, s, nil
+}
+
+// subscribeOwner подписывается на события всех выражений пользователя owner;
+// если пользователи не различаются (Auth не задан) — на все выражения.
+func subscribeOwner(owner string) *subscriber {
+	mu.Lock()
+	defer mu.Unlock()
+	return subscribe(&subscriber{owner: owner, anyOwner: Auth == nil})
+}
+
+func subscribe(s *subscriber) *subscriber {
+	s.events = make(chan Event, EventBuffer)
+	subscribers[s] = true
+	return s
+}
+
+// unsubscribe отменяет подписку.
+func unsubscribe(s *subscriber) {
+	mu.Lock()
+	defer mu.Unlock()
+	if subscribers[s] {
+		delete(subscribers, s)
+		close(s.events)
+	}
+}
+
+// streamPing — период пустых сообщений, не дающих прокси закрыть соединение.
+var streamPing = 15 * time.Second
+
+// stream передает события подписчика в send, пока не отменен ctx, не
+// закрыта подписка или, если stopOnFinal, выражение не перешло в конечное
+// состояние.
+func stream(ctx context.Context, s *subscriber, stopOnFinal bool, send func(Event) error, ping func() error) {
+	defer unsubscribe(s)
+	ticker := time.NewTicker(streamPing)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok || send(e) != nil || stopOnFinal && e.final() {
+				return
+			}
+		case <-ticker.C:
+			if ping() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"sync"
+)
+
+// crockford — алфавит Base32 Крокфорда, используемый в ULID.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	idMu     sync.Mutex
+	lastTime int64
+	lastRand [10]byte
+)
+
+// newID создает идентификатор в формате ULID: 48 бит времени в миллисекундах
+// и 80 случайных бит, всего 26 символов. Идентификаторы сортируются по
+// времени создания; внутри одной миллисекунды случайная часть увеличивается
+// на единицу, поэтому порядок сохраняется и без повторов.
+func newID() string {
+	idMu.Lock()
+	defer idMu.Unlock()
+
+	ms := now().UnixMilli()
+	if ms <= lastTime {
+		ms = lastTime
+		for i := len(lastRand) - 1; i >= 0; i-- {
+			lastRand[i]++
+			if lastRand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(lastRand[:])
+	}
+	lastTime = ms
+
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(b[6:], lastRand[:])
+	return encodeULID(b)
+}
+
+// encodeULID кодирует 128 бит в 26 символов по 5 бит, начиная со старших;
+// первый символ несет только 3 бита.
+func encodeULID(b [16]byte) string {
+	var out [26]byte
+	var acc uint32
+	bits := 2 // дополняем 128 бит до 130 нулями слева
+	i := 0
+	for _, c := range b {
+		acc = acc<<8 | uint32(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[i] = crockford[acc>>bits&31]
+			i++
+		}
+	}
+	return string(out[:])
+}
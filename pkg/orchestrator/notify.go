@@ -0,0 +1,71 @@
+package orchestrator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/terlyne/go-calculator/pkg/agent"
+)
+
+// MaxTaskWait ограничивает время ожидания задачи в GET /internal/task?wait=.
+var MaxTaskWait = time.Minute
+
+// notifier будит агентов, ожидающих задачу: wait возвращает канал, который
+// закрывается при следующем вызове notify.
+type notifier struct {
+	mu    sync.Mutex
+	ready chan struct{}
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready == nil {
+		n.ready = make(chan struct{})
+	}
+	return n.ready
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready != nil {
+		close(n.ready)
+		n.ready = nil
+	}
+}
+
+// taskReady сообщает о задачах, появившихся в очереди или с истекшей арендой.
+var taskReady notifier
+
+// notifyAt будит ожидающих агентов в момент deadline, когда истекает аренда
+// и задачу можно выдать снова.
+func notifyAt(deadline time.Time) {
+	time.AfterFunc(time.Until(deadline)+time.Millisecond, taskReady.notify)
+}
+
+// WaitTask выдает задачу, как NextTask, а если готовых задач нет — ждет
+// появления задачи не дольше wait или до отмены ctx.
+func WaitTask(ctx context.Context, agentID string, wait time.Duration) (agent.Task, bool, error) {
+	if wait > MaxTaskWait {
+		wait = MaxTaskWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		// канал берется до проверки очереди, чтобы не пропустить уведомление
+		ready := taskReady.wait()
+		task, ok, err := NextTask(agentID)
+		if err != nil || ok {
+			return task, ok, err
+		}
+		select {
+		case <-ready:
+		case <-timer.C:
+			return agent.Task{}, false, nil
+		case <-ctx.Done():
+			return agent.Task{}, false, nil
+		}
+	}
+}
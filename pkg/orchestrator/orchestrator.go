@@ -1,139 +1,577 @@
 package orchestrator
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/terlyne/go-calculator/pkg/calculator"
+	"github.com/terlyne/go-calculator/internal/auth"
+	"github.com/terlyne/go-calculator/internal/database"
+	"github.com/terlyne/go-calculator/pkg/agent"
+	"golang.org/x/net/websocket"
 )
 
 type Expression struct {
-	ID     string  `json:"id"`
-	Status string  `json:"status"`
-	Result *string `json:"result,omitempty"`
+	ID         string    `json:"id"`
+	Expression string    `json:"expression,omitempty"`
+	Status     string    `json:"status"`
+	Result     *string   `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Owner — логин пользователя, отправившего выражение
+	Owner    string `json:"owner,omitempty"`
+	Priority int    `json:"priority"`
+	// CallbackURL получает вебхук с выражением, когда оно вычислено или
+	// завершилось ошибкой
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Variables — значения переменных выражения
+	Variables map[string]float64 `json:"variables,omitempty"`
+	// BatchID — пакет, в котором отправлено выражение; Ref — ссылка клиента
+	// на выражение в пакете
+	BatchID string `json:"batch_id,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	// Seed — начальное значение генератора случайных функций выражения
+	Seed int64 `json:"seed"`
 }
 
-var (
-	expressions = make(map[string]*Expression)
-	mu          sync.Mutex
-)
+// mu защищает состояние планировщика
+var mu sync.Mutex
 
 func AddExpression(id string) {
-	mu.Lock()
-	defer mu.Unlock()
-	expressions[id] = &Expression{ID: id, Status: "pending"}
+	if err := store.CreateExpression(Expression{ID: id, Status: statusPending, CreatedAt: now()}); err != nil {
+		log.Printf("Ошибка сохранения выражения %s: %v", id, err)
+	}
 }
 
 func GetExpressions() []Expression {
-	mu.Lock()
-	defer mu.Unlock()
-	var result []Expression
-	for _, expr := range expressions {
-		result = append(result, *expr)
+	result, err := store.ListExpressions()
+	if err != nil {
+		log.Printf("Ошибка чтения выражений: %v", err)
 	}
 	return result
 }
 
 func GetExpressionByID(id string) (*Expression, bool) {
-	mu.Lock()
-	defer mu.Unlock()
-	expr, exists := expressions[id]
-	return expr, exists
+	expr, exists, err := store.GetExpression(id)
+	if err != nil {
+		log.Printf("Ошибка чтения выражения %s: %v", id, err)
+	}
+	return &expr, exists
 }
 
 func UpdateExpression(id string, result string) {
 	mu.Lock()
 	defer mu.Unlock()
-	if expr, exists := expressions[id]; exists {
-		expr.Status = "completed"
+	if expr, exists, _ := store.GetExpression(id); exists {
+		expr.Status = statusCompleted
 		expr.Result = &result
+		store.UpdateExpression(expr)
+	}
+}
+
+// Address — адрес, на котором StartServer принимает запросы.
+var Address = ":8080"
+
+// Auth проверяет JWT-токены пользователей. Если он задан, отправка выражений
+// требует заголовка Authorization: Bearer <токен>, а задачи распределяются
+// между пользователями по SchedulingPolicy; иначе все отправки анонимны.
+var Auth *auth.Auth
+
+// owner возвращает логин пользователя из токена запроса. EventSource и
+// WebSocket в браузере не задают заголовков, поэтому токен принимается и в
+// параметре token.
+func owner(r *http.Request) (string, bool) {
+	if Auth == nil {
+		return "", true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return "", false
+	}
+	claims, err := Auth.ValidateToken(token)
+	if err != nil {
+		return "", false
+	}
+	return claims.Login, true
+}
+
+// ownedExpression возвращает выражение {id} запроса, если оно принадлежит
+// пользователю токена. Иначе отвечает 401 или 404: чужое выражение
+// неотличимо от несуществующего.
+func ownedExpression(w http.ResponseWriter, r *http.Request) (*Expression, bool) {
+	user, ok := owner(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+		return nil, false
 	}
+	expr, exists := GetExpressionByID(mux.Vars(r)["id"])
+	if !exists || Auth != nil && expr.Owner != user {
+		http.Error(w, `{"error": "Expression not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	return expr, true
 }
 
 func StartServer() {
+	go watchAgents()
+	http.ListenAndServe(Address, NewRouter())
+}
+
+// NewRouter создает обработчики публичного API и API агентов.
+func NewRouter() *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/v1/calculate", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := owner(r)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+			return
+		}
 		var req struct {
-			Expression string `json:"expression"`
+			Expression  string             `json:"expression"`
+			Priority    int                `json:"priority"`
+			CallbackURL string             `json:"callback_url"`
+			Variables   map[string]float64 `json:"variables"`
+			Seed        *int64             `json:"seed"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
 			return
 		}
-		id := "expr_" + strconv.Itoa(len(expressions)+1)
-		AddExpression(id)
+		// повтор запроса с тем же Idempotency-Key возвращает исходное выражение
+		id, replayed, err := SubmitExpression(Submission{
+			Expression:     req.Expression,
+			Owner:          user,
+			Priority:       req.Priority,
+			CallbackURL:    req.CallbackURL,
+			Variables:      req.Variables,
+			Seed:           req.Seed,
+			IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		})
+		switch err {
+		case errIdempotencyConflict:
+			http.Error(w, `{"error": "Idempotency-Key is already used for another expression"}`, http.StatusConflict)
+			return
+		case errInvalidPriority:
+			http.Error(w, `{"error": "Priority must be between 0 and 9"}`, http.StatusBadRequest)
+			return
+		case errInvalidCallback:
+			http.Error(w, `{"error": "callback_url must be an absolute http or https URL of a public host"}`, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		if replayed {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	}).Methods("POST")
 
-		go func() {
-			// логика для вычисления
-			result, err := calculateExpression(req.Expression)
-			if err != nil {
-				UpdateExpression(id, "Error: "+err.Error())
-			} else {
-				UpdateExpression(id, strconv.FormatFloat(result, 'f', -1, 64))
-			}
-		}()
+	r.HandleFunc("/api/v1/calculate/batch", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := owner(r)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Items       []BatchItem `json:"items"`
+			Priority    int         `json:"priority"`
+			CallbackURL string      `json:"callback_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		batch, results, err := SubmitBatch(Submission{Owner: user, Priority: req.Priority, CallbackURL: req.CallbackURL}, req.Items)
+		switch err {
+		case nil:
+		case errEmptyBatch:
+			http.Error(w, `{"error": "Batch must contain at least one expression"}`, http.StatusBadRequest)
+			return
+		case errBatchTooLarge:
+			http.Error(w, fmt.Sprintf(`{"error": "Batch must contain at most %d expressions"}`, MaxBatchSize), http.StatusRequestEntityTooLarge)
+			return
+		case errInvalidPriority:
+			http.Error(w, `{"error": "Priority must be between 0 and 9"}`, http.StatusBadRequest)
+			return
+		case errInvalidCallback:
+			http.Error(w, `{"error": "callback_url must be an absolute http or https URL of a public host"}`, http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, `{"error": "Failed to submit batch"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"id": id})
+		json.NewEncoder(w).Encode(struct {
+			BatchID string        `json:"batch_id"`
+			Items   []BatchResult `json:"items"`
+		}{batch.ID, results})
 	}).Methods("POST")
 
+	r.HandleFunc("/api/v1/batches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := owner(r)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		status, exprs, err := GetBatch(mux.Vars(r)["id"])
+		if err == errBatchNotFound || err == nil && Auth != nil && status.Owner != user {
+			http.Error(w, `{"error": "Batch not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error": "Failed to get batch"}`, http.StatusInternalServerError)
+			return
+		}
+		if exprs == nil {
+			exprs = []Expression{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Batch       BatchStatus  `json:"batch"`
+			Expressions []Expression `json:"expressions"`
+		}{status, exprs})
+	}).Methods("GET")
+
+	// Список постраничный; с Auth пользователь видит только свои выражения
 	r.HandleFunc("/api/v1/expressions", func(w http.ResponseWriter, r *http.Request) {
-		exprs := GetExpressions()
+		user, ok := owner(r)
+		if !ok {
+			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		query, err := database.ParseExpressionQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+		var only *string
+		if Auth != nil {
+			only = &user
+		}
+		exprs, next, err := QueryExpressions(only, query)
+		if err != nil {
+			http.Error(w, `{"error": "Failed to list expressions"}`, http.StatusInternalServerError)
+			return
+		}
+		if exprs == nil {
+			exprs = []Expression{}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string][]Expression{"expressions": exprs})
+		json.NewEncoder(w).Encode(struct {
+			Expressions []Expression `json:"expressions"`
+			NextCursor  string       `json:"next_cursor,omitempty"`
+		}{exprs, next})
 	}).Methods("GET")
 
 	r.HandleFunc("/api/v1/expressions/{id}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
+		expr, ok := ownedExpression(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]Expression{"expression": *expr})
+	}).Methods("GET")
 
-		expr, exists := GetExpressionByID(id)
-		if !exists {
+	r.HandleFunc("/api/v1/expressions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ownedExpression(w, r); !ok {
+			return
+		}
+		switch err := DeleteExpression(mux.Vars(r)["id"]); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errExpressionNotFound:
+			http.Error(w, `{"error": "Expression not found"}`, http.StatusNotFound)
+		default:
+			http.Error(w, `{"error": "Failed to delete expression"}`, http.StatusInternalServerError)
+		}
+	}).Methods("DELETE")
+
+	r.HandleFunc("/api/v1/expressions/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ownedExpression(w, r); !ok {
+			return
+		}
+		expr, err := CancelExpression(mux.Vars(r)["id"])
+		switch err {
+		case nil:
+		case errExpressionNotFound:
 			http.Error(w, `{"error": "Expression not found"}`, http.StatusNotFound)
 			return
+		case errExpressionFinished:
+			http.Error(w, `{"error": "Expression is already finished"}`, http.StatusConflict)
+			return
+		default:
+			http.Error(w, `{"error": "Failed to cancel expression"}`, http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]Expression{"expression": expr})
+	}).Methods("POST")
 
+	r.HandleFunc("/api/v1/expressions/{id}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ownedExpression(w, r); !ok {
+			return
+		}
+		deliveries, err := ListDeliveries(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, `{"error": "Failed to list deliveries"}`, http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]Expression{"expression": *expr})
+		json.NewEncoder(w).Encode(map[string][]Delivery{"deliveries": deliveries})
 	}).Methods("GET")
 
+	// Потоки событий: выражение завершается вместе со своим потоком, поток
+	// пользователя открыт, пока клиент не отключится
+	r.HandleFunc("/api/v1/expressions/{id}/events", serveSSE).Methods("GET")
+	r.HandleFunc("/api/v1/expressions/{id}/ws", serveWebSocket).Methods("GET")
+	r.HandleFunc("/api/v1/events", serveSSE).Methods("GET")
+	r.HandleFunc("/api/v1/ws", serveWebSocket).Methods("GET")
+
+	// С параметром wait (например, ?wait=30s) запрос ждет появления задачи
 	r.HandleFunc("/internal/task", func(w http.ResponseWriter, r *http.Request) {
-		mu.Lock()
-		defer mu.Unlock()
-
-		// Найти первое выражение со статусом "pending"
-		for _, expr := range expressions {
-			if expr.Status == "pending" {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(expr)
+		var wait time.Duration
+		if param := r.URL.Query().Get("wait"); param != "" {
+			var err error
+			if wait, err = time.ParseDuration(param); err != nil || wait < 0 {
+				http.Error(w, `{"error": "Invalid wait duration"}`, http.StatusBadRequest)
 				return
 			}
 		}
-
-		http.Error(w, `{"error": "No tasks available"}`, http.StatusNotFound)
+		task, ok, err := WaitTask(r.Context(), r.URL.Query().Get("agent"), wait)
+		if err == errAgentNotFound {
+			http.Error(w, `{"error": "Agent is not registered"}`, http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error": "Failed to get task"}`, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, `{"error": "No tasks available"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(task)
 	}).Methods("GET")
 
 	r.HandleFunc("/internal/task", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			ID     string  `json:"id"`
-			Result float64 `json:"result"`
+		var req agent.Result
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+
+		if err := SubmitResult(req); err != nil {
+			writeTaskError(w, err)
+			return
 		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods("POST")
+
+	// Агент продлевает аренду выполняемой задачи и узнает, не отменено ли выражение
+	r.HandleFunc("/internal/task/{id}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		var req agent.Heartbeat
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
 			return
 		}
+		deadline, err := Heartbeat(mux.Vars(r)["id"], req.LeaseID)
+		if err != nil {
+			writeTaskError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]time.Time{"lease_deadline": deadline})
+	}).Methods("POST")
 
-		UpdateExpression(req.ID, strconv.FormatFloat(req.Result, 'f', -1, 64))
+	r.HandleFunc("/internal/agents", func(w http.ResponseWriter, r *http.Request) {
+		var reg agent.Registration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]AgentInfo{"agent": RegisterAgent(reg)})
+	}).Methods("POST")
 
+	r.HandleFunc("/internal/agents/{id}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if err := AgentHeartbeat(mux.Vars(r)["id"]); err != nil {
+			http.Error(w, `{"error": "Agent is not registered"}`, http.StatusNotFound)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}).Methods("POST")
 
-	http.ListenAndServe(":8080", r)
+	r.HandleFunc("/internal/agents", listAgents).Methods("GET")
+
+	// Административный API требует заголовка X-Admin-Token
+	admin := r.PathPrefix("/api/v1/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/agents", listAgents).Methods("GET")
+	admin.HandleFunc("/agents/{id}", func(w http.ResponseWriter, r *http.Request) {
+		switch err := EvictAgent(mux.Vars(r)["id"]); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errAgentNotFound:
+			http.Error(w, `{"error": "Agent not found"}`, http.StatusNotFound)
+		default:
+			http.Error(w, `{"error": "Failed to evict agent"}`, http.StatusInternalServerError)
+		}
+	}).Methods("DELETE")
+	admin.HandleFunc("/cache", cacheStats).Methods("GET")
+
+	return r
+}
+
+// AdminToken открывает доступ к /api/v1/admin; пустой токен отключает
+// административный API.
+var AdminToken string
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+			http.Error(w, `{"error": "Forbidden"}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listAgents отдает агентов с текущими задачами и пропускной способностью.
+func listAgents(w http.ResponseWriter, r *http.Request) {
+	list, err := ListAgents()
+	if err != nil {
+		http.Error(w, `{"error": "Failed to list agents"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]AgentInfo{"agents": list})
 }
 
-func calculateExpression(expression string) (float64, error) {
-	return calculator.Calc(expression)
+// subscription подписывает запрос на события выражения {id} или, если id в
+// пути нет, на все выражения пользователя. Второй результат сообщает, что
+// поток закончится вместе с выражением.
+func subscription(w http.ResponseWriter, r *http.Request) (*subscriber, bool, bool) {
+	user, ok := owner(r)
+	if !ok {
+		http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+		return nil, false, false
+	}
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		return subscribeOwner(user), false, true
+	}
+	expr, s, err := subscribeExpression(id)
+	if err == nil && Auth != nil && expr.Owner != user {
+		unsubscribe(s)
+		err = errExpressionNotFound
+	}
+	switch err {
+	case nil:
+		return s, true, true
+	case errExpressionNotFound:
+		http.Error(w, `{"error": "Expression not found"}`, http.StatusNotFound)
+	default:
+		http.Error(w, `{"error": "Failed to subscribe"}`, http.StatusInternalServerError)
+	}
+	return nil, false, false
+}
+
+// serveSSE передает события в формате Server-Sent Events.
+func serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error": "Streaming is not supported"}`, http.StatusInternalServerError)
+		return
+	}
+	s, stopOnFinal, ok := subscription(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		_, err := io.WriteString(w, ": ping\n\n")
+		flusher.Flush()
+		return err
+	}
+	stream(r.Context(), s, stopOnFinal, send, ping)
+}
+
+// serveWebSocket передает события JSON-сообщениями по WebSocket.
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	s, stopOnFinal, ok := subscription(w, r)
+	if !ok {
+		return
+	}
+	// если рукопожатие не удалось, обработчик не вызывается
+	defer unsubscribe(s)
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		// клиент ничего не отправляет: чтение завершается, когда он закрывает соединение
+		go func() {
+			io.Copy(io.Discard, ws)
+			cancel()
+		}()
+		send := func(e Event) error {
+			return websocket.JSON.Send(ws, e)
+		}
+		ping := func() error {
+			ws.PayloadType = websocket.PingFrame
+			_, err := ws.Write(nil)
+			return err
+		}
+		stream(ctx, s, stopOnFinal, send, ping)
+	}}.ServeHTTP(w, r)
+}
+
+// writeTaskError отвечает агенту на отклоненный результат или продление аренды.
+func writeTaskError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTaskNotFound:
+		http.Error(w, `{"error": "Task not found"}`, http.StatusNotFound)
+	case errLeaseRequired:
+		http.Error(w, `{"error": "Lease ID is required"}`, http.StatusBadRequest)
+	case errStaleLease:
+		http.Error(w, `{"error": "Stale lease"}`, http.StatusConflict)
+	case errTaskCancelled:
+		http.Error(w, `{"error": "Expression was cancelled"}`, http.StatusGone)
+	default:
+		http.Error(w, `{"error": "Failed to save task"}`, http.StatusInternalServerError)
+	}
 }
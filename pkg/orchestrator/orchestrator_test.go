@@ -1,7 +1,28 @@
 package orchestrator
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/terlyne/go-calculator/internal/auth"
+	"github.com/terlyne/go-calculator/internal/database"
+	"github.com/terlyne/go-calculator/pkg/agent"
+	"github.com/terlyne/go-calculator/pkg/calculator"
+	"golang.org/x/net/websocket"
 )
 
 func TestAddExpression(t *testing.T) {
@@ -11,3 +32,1385 @@ func TestAddExpression(t *testing.T) {
 		t.Error(expr.Status)
 	}
 }
+
+// runAgent выполняет задачи из очереди, как это делает агент, пока они есть.
+func runAgent(t *testing.T, url string) int {
+	executed := 0
+	agentID := testAgent()
+	for {
+		resp, err := http.Get(url + "/internal/task?agent=" + agentID)
+		if err != nil {
+			t.Fatalf("GET /internal/task: %v", err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return executed
+		}
+		var task agent.Task
+		json.NewDecoder(resp.Body).Decode(&task)
+		resp.Body.Close()
+
+		args := []calculator.Value{calculator.Number(task.Arg1), calculator.Number(task.Arg2)}
+		if task.Args != nil {
+			args = args[:0]
+			for _, arg := range task.Args {
+				args = append(args, calculator.Number(arg))
+			}
+		}
+		result := agent.Result{ID: task.ID, LeaseID: task.LeaseID}
+		value, err := calculator.DefaultRegistry.Apply(task.Operation, args...)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Result, _ = value.Float()
+		body, _ := json.Marshal(result)
+		resp, err = http.Post(url+"/internal/task", "application/json", bytes.NewReader(body))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /internal/task: %v %v", err, resp)
+		}
+		resp.Body.Close()
+		executed++
+	}
+}
+
+// testAgent регистрирует агента, умеющего все операции, или продлевает его
+// регистрацию и возвращает его ID: задачи выдаются только
+// зарегистрированным агентам, а без них выражения получают статус unroutable.
+func testAgent() string {
+	return RegisterAgent(agent.Registration{ID: "test-agent", Hostname: "test"}).ID
+}
+
+func submit(t *testing.T, url, expression string) string {
+	resp, err := http.Post(url+"/api/v1/calculate", "application/json", strings.NewReader(`{"expression": "`+expression+`"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/v1/calculate %q: %v %v", expression, err, resp)
+	}
+	defer resp.Body.Close()
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	return created["id"]
+}
+
+func TestDistributedEvaluation(t *testing.T) {
+	testAgent()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	tests := []struct {
+		expression string
+		status     string
+		result     string
+		tasks      int
+	}{
+		{"(1 + 2) * (3 + 4) - mean(1, 2 * 3)", "completed", "17.5", 6},
+		{"2 + 2 * 2", "completed", "6", 2},
+		{"(1 + 2) * (2 + 1)", "completed", "9", 2},
+		{"7", "completed", "7", 0},
+		{"factor(12)", "completed", "[2, 2, 3]", 0},
+		{"((2024-01-10 - 2024-01-01) in days) * 2", "completed", "18", 1},
+		{"1 + 1 / (2 - 2)", "error", "", 2},
+	}
+	for _, test := range tests {
+		id := submit(t, server.URL, test.expression)
+		if executed := runAgent(t, server.URL); executed != test.tasks {
+			t.Errorf("%q: agents executed %d tasks, expected %d", test.expression, executed, test.tasks)
+		}
+		expr, _ := GetExpressionByID(id)
+		if expr.Status != test.status || test.result != "" && (expr.Result == nil || *expr.Result != test.result) {
+			t.Errorf("%q: got status %s, result %v, error %q", test.expression, expr.Status, expr.Result, expr.Error)
+		}
+	}
+
+	// независимые операции выдаются агентам одновременно
+	id := submit(t, server.URL, "(1 + 2) * (3 + 4)")
+	first, _, _ := NextTask(testAgent())
+	second, ok, _ := NextTask(testAgent())
+	if !ok || first.Operation != "+" || second.Operation != "+" {
+		t.Fatalf("expected two independent tasks, got %+v and %+v", first, second)
+	}
+	if _, ok, _ := NextTask(testAgent()); ok {
+		t.Fatal("multiplication must wait for both additions")
+	}
+	SubmitResult(agent.Result{ID: second.ID, LeaseID: second.LeaseID, Result: 7})
+	SubmitResult(agent.Result{ID: first.ID, LeaseID: first.LeaseID, Result: 3})
+	if err := SubmitResult(agent.Result{ID: first.ID, LeaseID: first.LeaseID, Result: 100}); err != nil {
+		t.Errorf("duplicate result must be accepted idempotently, got %v", err)
+	}
+	last, ok, _ := NextTask(testAgent())
+	if !ok || last.Arg1 != 3 || last.Arg2 != 7 {
+		t.Fatalf("unexpected task %+v", last)
+	}
+	SubmitResult(agent.Result{ID: last.ID, LeaseID: last.LeaseID, Result: 21})
+	if expr, _ := GetExpressionByID(id); expr.Status != "completed" || *expr.Result != "21" {
+		t.Errorf("expected completed expression with result 21, got %+v", expr)
+	}
+
+	if err := SubmitResult(agent.Result{ID: "expr_missing.0", LeaseID: "x"}); err == nil {
+		t.Error("expected error for unknown task")
+	}
+	resp, _ := http.Post(server.URL+"/api/v1/calculate", "application/json", strings.NewReader(`{"expression": "2 +"}`))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for invalid expression, got %d", resp.StatusCode)
+	}
+}
+
+func TestTaskLeases(t *testing.T) {
+	testAgent()
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	OperationTimes = map[string]time.Duration{"*": 250 * time.Millisecond, "-": 100 * time.Millisecond, "unary-": 50 * time.Millisecond}
+	defer func() { OperationTimes = map[string]time.Duration{} }()
+	// унарный минус имеет свое время, отдельное от вычитания
+	for _, c := range []struct {
+		args []float64
+		want int64
+	}{{[]float64{5, 3}, 100}, {[]float64{5}, 50}} {
+		if got := (TaskRecord{Operation: "-", Args: c.args}).agentTask().OperationTime; got != c.want {
+			t.Errorf("operation_time of - with %d args: expected %d ms, got %d", len(c.args), c.want, got)
+		}
+	}
+	id := submit(t, server.URL, "2 * 21")
+	task, ok, _ := NextTask(testAgent())
+	if !ok || task.LeaseID == "" || !task.LeaseDeadline.Equal(current.Add(LeaseTimeout)) {
+		t.Fatalf("expected leased task, got %+v", task)
+	}
+	if _, ok, _ := NextTask(testAgent()); ok {
+		t.Fatal("leased task must not be handed out twice")
+	}
+	if task.OperationTime != 250 {
+		t.Errorf("expected operation_time 250 ms, got %d", task.OperationTime)
+	}
+
+	// агент пропал: после истечения аренды задача выдается снова
+	current = current.Add(LeaseTimeout + time.Second)
+	retry, ok, _ := NextTask(testAgent())
+	if !ok || retry.ID != task.ID || retry.LeaseID == task.LeaseID {
+		t.Fatalf("expected the task to be requeued with a new lease, got %+v", retry)
+	}
+
+	post := func(result agent.Result) int {
+		body, _ := json.Marshal(result)
+		resp, err := http.Post(server.URL+"/internal/task", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /internal/task: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 1}); code != http.StatusConflict {
+		t.Errorf("stale lease: expected 409, got %d", code)
+	}
+	if code := post(agent.Result{ID: task.ID, Result: 1}); code != http.StatusBadRequest {
+		t.Errorf("missing lease: expected 400, got %d", code)
+	}
+	if code := post(agent.Result{ID: retry.ID, LeaseID: retry.LeaseID, Result: 42}); code != http.StatusOK {
+		t.Errorf("current lease: expected 200, got %d", code)
+	}
+	if code := post(agent.Result{ID: retry.ID, LeaseID: retry.LeaseID, Result: 42}); code != http.StatusOK {
+		t.Errorf("duplicate result: expected 200, got %d", code)
+	}
+	if expr, _ := GetExpressionByID(id); expr.Status != "completed" || *expr.Result != "42" {
+		t.Errorf("expected completed expression with result 42, got %+v", expr)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	testAgent()
+	path := t.TempDir() + "/storage.db"
+	db, err := database.NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Open(NewSQLiteStore(db)); err != nil {
+		t.Fatal(err)
+	}
+	defer Open(NewMemoryStore())
+
+	id, _, _ := SubmitExpression(Submission{Expression: "(1 + 2) * (3 + 4)"})
+	first, _, _ := NextTask(testAgent())
+	second, _, _ := NextTask(testAgent())
+	if err := SubmitResult(agent.Result{ID: first.ID, LeaseID: first.LeaseID, Result: 3}); err != nil {
+		t.Fatal(err)
+	}
+	keyed, _, _ := SubmitExpression(Submission{Expression: "5 - 1", IdempotencyKey: "restart-key"})
+
+	// перезапуск: состояние читается заново из той же базы
+	restarted, err := database.NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if err := Open(NewSQLiteStore(restarted)); err != nil {
+		t.Fatal(err)
+	}
+	if retry, replayed, _ := SubmitExpression(Submission{Expression: "5 - 1", IdempotencyKey: "restart-key"}); !replayed || retry != keyed {
+		t.Errorf("idempotency key must survive restart, got %s", retry)
+	}
+	if task, ok, _ := NextTask(testAgent()); !ok || task.Operation != "-" {
+		t.Fatalf("expected the queued subtraction, got %+v", task)
+	}
+	if _, ok, _ := NextTask(testAgent()); ok {
+		t.Fatal("the leased task must stay with its agent after restart")
+	}
+	if err := SubmitResult(agent.Result{ID: second.ID, LeaseID: second.LeaseID, Result: 7}); err != nil {
+		t.Fatalf("lease must survive restart, got %v", err)
+	}
+	last, ok, _ := NextTask(testAgent())
+	if !ok || last.Arg1 != 3 || last.Arg2 != 7 {
+		t.Fatalf("unexpected task %+v", last)
+	}
+	SubmitResult(agent.Result{ID: last.ID, LeaseID: last.LeaseID, Result: 21})
+	if expr, _ := GetExpressionByID(id); expr.Status != "completed" || *expr.Result != "21" {
+		t.Errorf("expected completed expression with result 21, got %+v", expr)
+	}
+
+	next, _, _ := SubmitExpression(Submission{Expression: "1 + 1"})
+	if next == id {
+		t.Errorf("expression ID %s reused after restart", next)
+	}
+}
+
+func TestSeededRandom(t *testing.T) {
+	testAgent()
+	path := t.TempDir() + "/storage.db"
+	db, err := database.NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer Open(NewMemoryStore())
+
+	// randint ждет результата агента, rand() вычисляется сразу
+	expression := "randint(1, 999 + 1) + rand()"
+	evaluate := func(id string) Expression {
+		for {
+			task, ok, _ := NextTask(testAgent())
+			if !ok {
+				break
+			}
+			value, _ := calculator.DefaultRegistry.Apply(task.Operation, calculator.Number(task.Arg1), calculator.Number(task.Arg2))
+			result, _ := value.Float()
+			SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: result})
+		}
+		expr, _ := GetExpressionByID(id)
+		if expr.Status != statusCompleted {
+			t.Fatalf("%q: got status %s, error %q", expr.Expression, expr.Status, expr.Error)
+		}
+		return *expr
+	}
+	seeded := func(seed int64) Submission {
+		return Submission{Expression: expression, Seed: &seed}
+	}
+
+	Open(NewMemoryStore())
+	id, _, _ := SubmitExpression(seeded(42))
+	first := evaluate(id)
+	id, _, _ = SubmitExpression(seeded(42))
+	if second := evaluate(id); *second.Result != *first.Result || second.Seed != 42 {
+		t.Errorf("same seed gave %s and %s", *first.Result, *second.Result)
+	}
+	id, _, _ = SubmitExpression(seeded(7))
+	if other := evaluate(id); *other.Result == *first.Result {
+		t.Errorf("different seeds gave the same result %s", *other.Result)
+	}
+
+	// seed хранится вместе с выражением и переживает перезапуск
+	if err := Open(NewSQLiteStore(db)); err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ = SubmitExpression(seeded(42))
+	restarted, err := database.NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if err := Open(NewSQLiteStore(restarted)); err != nil {
+		t.Fatal(err)
+	}
+	if recovered := evaluate(id); *recovered.Result != *first.Result || recovered.Seed != 42 {
+		t.Errorf("after restart: got %s with seed %d, expected %s", *recovered.Result, recovered.Seed, *first.Result)
+	}
+
+	// выбранный оркестратором seed воспроизводит результат
+	id, _, _ = SubmitExpression(Submission{Expression: expression})
+	random := evaluate(id)
+	id, _, _ = SubmitExpression(seeded(random.Seed))
+	if replayed := evaluate(id); *replayed.Result != *random.Result {
+		t.Errorf("seed %d gave %s and %s", random.Seed, *random.Result, *replayed.Result)
+	}
+}
+
+func TestIdempotentSubmission(t *testing.T) {
+	testAgent()
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	// параллельные отправки получают разные идентификаторы, упорядоченные по времени
+	ids := make([]string, 50)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _, _ = SubmitExpression(Submission{Expression: "1 + 1"})
+		}(i)
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if len(id) != 26 || seen[id] {
+			t.Fatalf("expected unique 26-character IDs, got %q", id)
+		}
+		seen[id] = true
+	}
+	current = current.Add(time.Millisecond)
+	later, _, _ := SubmitExpression(Submission{Expression: "1 + 1"})
+	sort.Strings(ids)
+	if later <= ids[len(ids)-1] {
+		t.Errorf("ID %s must sort after %s", later, ids[len(ids)-1])
+	}
+
+	post := func(key, expression string) (int, string) {
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/calculate", strings.NewReader(`{"expression": "`+expression+`"}`))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/v1/calculate: %v", err)
+		}
+		defer resp.Body.Close()
+		var created map[string]string
+		json.NewDecoder(resp.Body).Decode(&created)
+		return resp.StatusCode, created["id"]
+	}
+	code, id := post("retry-1", "2 * 3")
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code, retry := post("retry-1", "2 * 3"); code != http.StatusOK || retry != id {
+		t.Errorf("retry: expected 200 with ID %s, got %d with %s", id, code, retry)
+	}
+	if code, _ := post("retry-1", "2 * 4"); code != http.StatusConflict {
+		t.Errorf("reused key: expected 409, got %d", code)
+	}
+
+	current = current.Add(IdempotencyWindow)
+	if code, fresh := post("retry-1", "2 * 3"); code != http.StatusCreated || fresh == id {
+		t.Errorf("expired key: expected a new expression, got %d with %s", code, fresh)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	testAgent()
+	memory := NewMemoryStore()
+	Open(memory)
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	do := func(method, path string, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	runAgent(t, server.URL)
+	id := submit(t, server.URL, "(1 + 2) * (3 + 4)")
+	running, _, _ := NextTask(testAgent())
+	heartbeat := `{"lease_id": "` + running.LeaseID + `"}`
+	if code := do("POST", "/internal/task/"+running.ID+"/heartbeat", heartbeat); code != http.StatusOK {
+		t.Errorf("heartbeat: expected 200, got %d", code)
+	}
+
+	if code := do("POST", "/api/v1/expressions/"+id+"/cancel", ""); code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d", code)
+	}
+	if expr, _ := GetExpressionByID(id); expr.Status != "cancelled" {
+		t.Errorf("expected cancelled expression, got %+v", expr)
+	}
+	if task, ok, _ := NextTask(testAgent()); ok {
+		t.Errorf("tasks of a cancelled expression must not be dispatched, got %+v", task)
+	}
+	// очередь хранилища не держит задачи завершенных выражений
+	if len(memory.queue) != 0 {
+		t.Errorf("queue must be empty after cancel, got %v", memory.queue)
+	}
+	if code := do("POST", "/internal/task/"+running.ID+"/heartbeat", heartbeat); code != http.StatusGone {
+		t.Errorf("heartbeat after cancel: expected 410, got %d", code)
+	}
+	result := `{"id": "` + running.ID + `", "lease_id": "` + running.LeaseID + `", "result": 3}`
+	if code := do("POST", "/internal/task", result); code != http.StatusGone {
+		t.Errorf("result after cancel: expected 410, got %d", code)
+	}
+	if code := do("POST", "/api/v1/expressions/"+id+"/cancel", ""); code != http.StatusOK {
+		t.Errorf("repeated cancel: expected 200, got %d", code)
+	}
+
+	done := submit(t, server.URL, "7")
+	if code := do("POST", "/api/v1/expressions/"+done+"/cancel", ""); code != http.StatusConflict {
+		t.Errorf("cancel of a completed expression: expected 409, got %d", code)
+	}
+	if tasks, _ := memory.ListTasks(id); len(tasks) == 0 || len(memory.queue) != 0 {
+		t.Errorf("finished tasks must stay listed but leave the queue, got %v and %v", tasks, memory.queue)
+	}
+
+	if code := do("DELETE", "/api/v1/expressions/"+id, ""); code != http.StatusNoContent {
+		t.Errorf("delete: expected 204, got %d", code)
+	}
+	if code := do("GET", "/api/v1/expressions/"+id, ""); code != http.StatusNotFound {
+		t.Errorf("deleted expression: expected 404, got %d", code)
+	}
+	if code := do("DELETE", "/api/v1/expressions/"+id, ""); code != http.StatusNotFound {
+		t.Errorf("repeated delete: expected 404, got %d", code)
+	}
+	if code := do("POST", "/api/v1/expressions/missing/cancel", ""); code != http.StatusNotFound {
+		t.Errorf("cancel of unknown expression: expected 404, got %d", code)
+	}
+}
+
+func TestSchedulingPolicy(t *testing.T) {
+	testAgent()
+	defer func(policy Policy) { SchedulingPolicy, UserWeights = policy, map[string]float64{} }(SchedulingPolicy)
+
+	// claimOrder отправляет выражения пользователей и возвращает владельцев
+	// задач в порядке их выдачи агентам.
+	claimOrder := func(submissions ...Submission) string {
+		Open(NewMemoryStore())
+		for _, sub := range submissions {
+			if _, _, err := SubmitExpression(sub); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var order []string
+		for {
+			task, ok, _ := NextTask(testAgent())
+			if !ok {
+				return strings.Join(order, " ")
+			}
+			ref, _ := parseTaskID(task.ID)
+			expr, _ := GetExpressionByID(ref.exprID)
+			order = append(order, expr.Owner)
+		}
+	}
+	repeat := func(sub Submission, n int) []Submission {
+		result := make([]Submission, n)
+		for i := range result {
+			result[i] = sub
+		}
+		return result
+	}
+	alice := repeat(Submission{Expression: "1 + 1", Owner: "alice"}, 4)
+	bob := repeat(Submission{Expression: "2 + 2", Owner: "bob"}, 2)
+	urgent := Submission{Expression: "3 + 3", Owner: "bob", Priority: 5}
+	// поток срочных выражений одного пользователя
+	flood := repeat(Submission{Expression: "1 + 1", Owner: "alice", Priority: 9}, 4)
+
+	tests := []struct {
+		policy      Policy
+		weights     map[string]float64
+		submissions []Submission
+		order       string
+	}{
+		{PolicyFIFO, nil, append(alice, bob...), "alice alice alice alice bob bob"},
+		{PolicyFair, nil, append(alice, bob...), "alice bob alice bob alice alice"},
+		{PolicyFair, map[string]float64{"alice": 2}, append(alice, bob...), "alice bob alice alice bob alice"},
+		{PolicyFair, nil, append(alice, urgent), "bob alice alice alice alice"},
+		{PolicyFIFO, nil, append(alice, urgent), "bob alice alice alice alice"},
+		{PolicyFair, nil, append(flood, bob...), "alice bob alice bob alice alice"},
+		{PolicyFIFO, nil, append(flood, bob...), "alice alice alice alice bob bob"},
+	}
+	for _, test := range tests {
+		SchedulingPolicy, UserWeights = test.policy, test.weights
+		if order := claimOrder(test.submissions...); order != test.order {
+			t.Errorf("%s %v: got order %q, expected %q", test.policy, test.weights, order, test.order)
+		}
+	}
+	Open(NewMemoryStore())
+
+	Auth = auth.NewAuth("secret")
+	defer func() { Auth = nil }()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+	token, _ := Auth.GenerateToken(1, "alice")
+	post := func(token, body string) int {
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/calculate", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/v1/calculate: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("", `{"expression": "1 + 1"}`); code != http.StatusUnauthorized {
+		t.Errorf("missing token: expected 401, got %d", code)
+	}
+	if code := post(token, `{"expression": "1 + 1", "priority": 10}`); code != http.StatusBadRequest {
+		t.Errorf("invalid priority: expected 400, got %d", code)
+	}
+	if code := post(token, `{"expression": "1 + 1", "priority": 3}`); code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", code)
+	}
+	if exprs := GetExpressions(); len(exprs) != 1 || exprs[0].Owner != "alice" || exprs[0].Priority != 3 {
+		t.Errorf("expected an expression of alice with priority 3, got %+v", exprs)
+	}
+}
+
+func TestLongPolling(t *testing.T) {
+	testAgent()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+	runAgent(t, server.URL)
+
+	poll := func(wait string) (int, agent.Task, time.Duration) {
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/internal/task?agent=" + testAgent() + "&wait=" + wait)
+		if err != nil {
+			t.Fatalf("GET /internal/task: %v", err)
+		}
+		defer resp.Body.Close()
+		var task agent.Task
+		json.NewDecoder(resp.Body).Decode(&task)
+		return resp.StatusCode, task, time.Since(start)
+	}
+
+	if code, _, elapsed := poll("50ms"); code != http.StatusNotFound || elapsed < 50*time.Millisecond {
+		t.Errorf("empty queue: expected 404 after the wait, got %d after %v", code, elapsed)
+	}
+	if code, _, _ := poll("soon"); code != http.StatusBadRequest {
+		t.Errorf("invalid wait: expected 400, got %d", code)
+	}
+
+	// ожидающий агент получает задачу сразу после отправки выражения
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		submit(t, server.URL, "1 + 2")
+	}()
+	code, task, elapsed := poll("5s")
+	if code != http.StatusOK || task.Operation != "+" || elapsed > 2*time.Second {
+		t.Fatalf("expected the new task, got %d %+v after %v", code, task, elapsed)
+	}
+
+	// и задачу, аренда которой истекла
+	defer func(timeout time.Duration) { LeaseTimeout = timeout }(LeaseTimeout)
+	LeaseTimeout = 100 * time.Millisecond
+	submit(t, server.URL, "3 + 4")
+	lost, _, _ := NextTask(testAgent())
+	code, retry, elapsed := poll("5s")
+	if code != http.StatusOK || retry.ID != lost.ID || elapsed > 2*time.Second {
+		t.Errorf("expected the expired task, got %d %+v after %v", code, retry, elapsed)
+	}
+}
+
+func TestAgentRegistry(t *testing.T) {
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func(lease time.Duration) { now, LeaseTimeout, AdminToken = time.Now, lease, "" }(LeaseTimeout)
+	LeaseTimeout = time.Hour
+	Open(NewMemoryStore())
+	agents = make(map[string]*agentState)
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	call := func(method, path, body string, header ...string) (int, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.Bytes()
+	}
+	register := func(reg agent.Registration) string {
+		body, _ := json.Marshal(reg)
+		code, resp := call("POST", "/internal/agents", string(body))
+		var created map[string]AgentInfo
+		json.Unmarshal(resp, &created)
+		if code != http.StatusCreated || created["agent"].ID == "" {
+			t.Fatalf("register: got %d %s", code, resp)
+		}
+		return created["agent"].ID
+	}
+	claim := func(agentID string) (int, agent.Task) {
+		code, resp := call("GET", "/internal/task?agent="+agentID, "")
+		var task agent.Task
+		json.Unmarshal(resp, &task)
+		return code, task
+	}
+	list := func() map[string]AgentInfo {
+		list, err := ListAgents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]AgentInfo{}
+		for _, info := range list {
+			result[info.ID] = info
+		}
+		return result
+	}
+
+	first := register(agent.Registration{Hostname: "host-1", Version: "1.0", Concurrency: 2, Operations: []string{"+", "*"}})
+	second := register(agent.Registration{Hostname: "host-2", Version: "1.0"})
+	submit(t, server.URL, "1 + 2")
+	submit(t, server.URL, "3 + 4")
+
+	if code, _ := claim("unknown"); code != http.StatusGone {
+		t.Errorf("unregistered agent: expected 410, got %d", code)
+	}
+	code, task := claim(first)
+	if code != http.StatusOK {
+		t.Fatalf("expected a task, got %d", code)
+	}
+	result, _ := json.Marshal(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 3})
+	call("POST", "/internal/task", string(result))
+	_, task = claim(first)
+
+	info := list()[first]
+	if info.Hostname != "host-1" || info.Concurrency != 2 || len(info.Tasks) != 1 || info.Tasks[0].ID != task.ID ||
+		info.Completed != 1 || info.Throughput != 1 {
+		t.Errorf("unexpected agent info %+v", info)
+	}
+	if info := list()[second]; info.Concurrency != 1 || len(info.Tasks) != 0 {
+		t.Errorf("unexpected agent info %+v", info)
+	}
+
+	// первый агент замолчал: его задача возвращается в очередь
+	current = current.Add(AgentTimeout + time.Second)
+	if code, _ := call("POST", "/internal/agents/"+second+"/heartbeat", ""); code != http.StatusOK {
+		t.Errorf("heartbeat: expected 200, got %d", code)
+	}
+	if _, ok := list()[first]; ok {
+		t.Error("silent agent must be evicted")
+	}
+	if code, _ := call("POST", "/internal/agents/"+first+"/heartbeat", ""); code != http.StatusNotFound {
+		t.Errorf("heartbeat of evicted agent: expected 404, got %d", code)
+	}
+	if code, retry := claim(second); code != http.StatusOK || retry.ID != task.ID {
+		t.Errorf("expected the evicted agent's task to be requeued, got %d %+v", code, retry)
+	}
+
+	// административный API
+	if code, _ := call("GET", "/api/v1/admin/agents", ""); code != http.StatusForbidden {
+		t.Errorf("admin API without token: expected 403, got %d", code)
+	}
+	AdminToken = "admin"
+	if code, resp := call("GET", "/api/v1/admin/agents", "", "X-Admin-Token", "admin"); code != http.StatusOK || !bytes.Contains(resp, []byte(second)) {
+		t.Errorf("admin API: got %d %s", code, resp)
+	}
+	third := register(agent.Registration{Hostname: "host-3"})
+	if code, _ := call("DELETE", "/api/v1/admin/agents/"+second, "", "X-Admin-Token", "admin"); code != http.StatusNoContent {
+		t.Errorf("evict: expected 204, got %d", code)
+	}
+	if code, _ := claim(""); code != http.StatusGone {
+		t.Errorf("agent without registration: expected 410, got %d", code)
+	}
+	if code, retry := claim(third); code != http.StatusOK || retry.ID != task.ID {
+		t.Errorf("expected the evicted agent's task to be requeued, got %d %+v", code, retry)
+	}
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	Open(NewMemoryStore())
+	agents = make(map[string]*agentState)
+	defer func() { agents = make(map[string]*agentState) }()
+
+	// пока в реестре нет агентов, выполнить задачу некому
+	id, _, _ := SubmitExpression(Submission{Expression: "1 + 1"})
+	if expr, _ := GetExpressionByID(id); expr.Status != "unroutable" {
+		t.Errorf("expected an unroutable expression without agents, got %+v", expr)
+	}
+
+	basic := RegisterAgent(agent.Registration{Operations: []string{"+", "-", "*", "/"}}).ID
+	stats := RegisterAgent(agent.Registration{Operations: []string{"mean"}, Modes: []string{agent.ModeFloat}}).ID
+	decimal := RegisterAgent(agent.Registration{Modes: []string{"decimal"}}).ID
+
+	id, _, _ = SubmitExpression(Submission{Expression: "mean(1, 2, 6) + 1"})
+	if task, ok, _ := NextTask(basic); ok {
+		t.Errorf("arithmetic agent must not get %s", task.Operation)
+	}
+	if task, ok, _ := NextTask(decimal); ok {
+		t.Errorf("agent without float64 mode must not get %s", task.Operation)
+	}
+	task, ok, _ := NextTask(stats)
+	if !ok || task.Operation != "mean" {
+		t.Fatalf("expected mean for the statistics agent, got %+v", task)
+	}
+	SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 3})
+	if task, ok, _ := NextTask(stats); ok {
+		t.Errorf("statistics agent must not get %s", task.Operation)
+	}
+	task, ok, _ = NextTask(basic)
+	if !ok || task.Operation != "+" {
+		t.Fatalf("expected + for the arithmetic agent, got %+v", task)
+	}
+	SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 4})
+	if expr, _ := GetExpressionByID(id); expr.Status != "completed" || *expr.Result != "4" {
+		t.Errorf("expected completed expression with result 4, got %+v", expr)
+	}
+
+	// ни один агент не умеет normcdf: выражение сразу получает статус unroutable
+	id, _, _ = SubmitExpression(Submission{Expression: "normcdf(1) * 2"})
+	if expr, _ := GetExpressionByID(id); expr.Status != "unroutable" || !strings.Contains(expr.Error, "normcdf") {
+		t.Errorf("expected an unroutable expression about normcdf, got %+v", expr)
+	}
+
+	// операции режима prob достаются только агентам с этим режимом
+	OperationModes = map[string]string{"normpdf": "prob"}
+	defer func() { OperationModes = map[string]string{} }()
+	id, _, _ = SubmitExpression(Submission{Expression: "normpdf(0) + 1"})
+	if expr, _ := GetExpressionByID(id); expr.Status != "unroutable" || !strings.Contains(expr.Error, "prob") {
+		t.Errorf("expected an unroutable expression without prob agents, got %+v", expr)
+	}
+	prob := RegisterAgent(agent.Registration{Modes: []string{"prob"}}).ID
+	id, _, _ = SubmitExpression(Submission{Expression: "normpdf(0) + 1"})
+	if task, ok, _ := NextTask(stats); ok {
+		t.Errorf("float64 agent must not get %s", task.Operation)
+	}
+	task, ok, _ = NextTask(prob)
+	if !ok || task.Operation != "normpdf" || task.Mode != "prob" {
+		t.Fatalf("expected normpdf in prob mode for the prob agent, got %+v", task)
+	}
+	SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 0})
+	if task, ok, _ := NextTask(prob); ok {
+		t.Errorf("prob agent must not get %s", task.Operation)
+	}
+	task, ok, _ = NextTask(basic)
+	if !ok || task.Operation != "+" || task.Mode != "" {
+		t.Fatalf("expected + in float64 mode for the arithmetic agent, got %+v", task)
+	}
+	SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 1})
+
+	// после удаления единственного агента, умеющего mean, ожидающее
+	// выражение получает статус unroutable
+	id, _, _ = SubmitExpression(Submission{Expression: "mean(1, 2) * 3"})
+	if err := EvictAgent(stats); err != nil {
+		t.Fatal(err)
+	}
+	if expr, _ := GetExpressionByID(id); expr.Status != "unroutable" || !strings.Contains(expr.Error, "mean") {
+		t.Errorf("expected an unroutable expression after eviction, got %+v", expr)
+	}
+	if _, _, err := NextTask("unknown"); err != errAgentNotFound {
+		t.Errorf("unknown agent: expected errAgentNotFound, got %v", err)
+	}
+
+	if modes, err := ParseOperationModes("normpdf=prob, tcdf = prob"); err != nil || modes["tcdf"] != "prob" {
+		t.Errorf("ParseOperationModes = %v, %v", modes, err)
+	}
+	if _, err := ParseOperationModes("normpdf"); err == nil {
+		t.Error("expected error for an operation without mode")
+	}
+}
+
+// readSSE читает события из потока Server-Sent Events, пока сервер не закроет
+// его или stop не вернет true.
+func readSSE(t *testing.T, body io.Reader, stop func(Event) bool) []Event {
+	var events []Event
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("bad event %q: %v", data, err)
+		}
+		events = append(events, e)
+		if stop != nil && stop(e) {
+			break
+		}
+	}
+	return events
+}
+
+func TestEventStreams(t *testing.T) {
+	testAgent()
+	Open(NewMemoryStore())
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return resp
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	user := get("/api/v1/events")
+	defer user.Body.Close()
+	if ct := user.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", ct)
+	}
+	userWS, err := websocket.Dial(wsURL+"/api/v1/ws", "", server.URL)
+	if err != nil {
+		t.Fatalf("websocket: %v", err)
+	}
+	defer userWS.Close()
+
+	id := submit(t, server.URL, "(1 + 2) * 3")
+	expr := get("/api/v1/expressions/" + id + "/events")
+	defer expr.Body.Close()
+	runAgent(t, server.URL)
+
+	// поток выражения закрывается сервером после конечного состояния
+	var got []string
+	events := readSSE(t, expr.Body, nil)
+	for _, e := range events {
+		got = append(got, e.Type+":"+e.Expression.Status)
+	}
+	expected := "status:pending status:in_progress task:in_progress task:in_progress status:completed"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expression stream: got %q, expected %q", strings.Join(got, " "), expected)
+	}
+	if last := events[len(events)-1]; last.Progress == nil || last.Progress.Done != last.Progress.Total || *last.Expression.Result != "9" {
+		t.Errorf("unexpected final event %+v", last)
+	}
+
+	completed := func(e Event) bool { return e.Expression.ID == id && e.Expression.Status == "completed" }
+	if events := readSSE(t, user.Body, completed); len(events) != 5 || events[0].Expression.Status != "pending" {
+		t.Errorf("user stream: unexpected events %+v", events)
+	}
+	for {
+		var e Event
+		if err := websocket.JSON.Receive(userWS, &e); err != nil {
+			t.Fatalf("user websocket: %v", err)
+		}
+		if completed(e) {
+			break
+		}
+	}
+
+	// подписка на завершенное выражение отдает его состояние и закрывается
+	ws, err := websocket.Dial(wsURL+"/api/v1/expressions/"+id+"/ws", "", server.URL)
+	if err != nil {
+		t.Fatalf("websocket: %v", err)
+	}
+	defer ws.Close()
+	var e Event
+	if err := websocket.JSON.Receive(ws, &e); err != nil || !completed(e) {
+		t.Errorf("expression websocket: got %+v, %v", e, err)
+	}
+	if err := websocket.JSON.Receive(ws, &e); err == nil {
+		t.Errorf("expression websocket must close after the final event, got %+v", e)
+	}
+
+	if resp := get("/api/v1/expressions/missing/events"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown expression: expected 404, got %d", resp.StatusCode)
+	}
+
+	Auth = auth.NewAuth("secret")
+	defer func() { Auth = nil }()
+	if resp := get("/api/v1/events"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("stream without token: expected 401, got %d", resp.StatusCode)
+	}
+	token, _ := Auth.GenerateToken(1, "bob")
+	if resp := get("/api/v1/expressions/" + id + "/events?token=" + token); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stream of another user's expression: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	testAgent()
+	db, err := database.NewDatabase(t.TempDir() + "/storage.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Open(NewSQLiteStore(db)); err != nil {
+		t.Fatal(err)
+	}
+	defer Open(NewMemoryStore())
+	defer func(backoff time.Duration) {
+		WebhookBackoff, WebhookSecret, UserWebhooks, WebhookAllowedHosts = backoff, "", map[string]string{}, nil
+	}(WebhookBackoff)
+	// получатель слушает loopback, поэтому его нужно разрешить явно
+	WebhookBackoff, WebhookSecret, WebhookAllowedHosts = time.Millisecond, "hook-secret", []string{"127.0.0.1"}
+
+	// получатель отвечает ошибкой на первую попытку доставки
+	var (
+		received sync.Mutex
+		bodies   []Expression
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Webhook-Timestamp")
+		if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+			t.Errorf("bad timestamp %q", timestamp)
+		}
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Signature"))
+		}
+		if r.Header.Get("X-Webhook-Attempt") == "1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload map[string]Expression
+		json.Unmarshal(body, &payload)
+		received.Lock()
+		bodies = append(bodies, payload["expression"])
+		received.Unlock()
+	}))
+	defer receiver.Close()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	post := func(body string) (int, string) {
+		resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /api/v1/calculate: %v", err)
+		}
+		defer resp.Body.Close()
+		var created map[string]string
+		json.NewDecoder(resp.Body).Decode(&created)
+		return resp.StatusCode, created["id"]
+	}
+	for _, callback := range []string{"ftp://example.com", "http://localhost:8080/hook", "http://10.0.0.5/hook", "http://169.254.169.254/latest", "http://[::1]/hook"} {
+		if code, _ := post(`{"expression": "1 + 2", "callback_url": "` + callback + `"}`); code != http.StatusBadRequest {
+			t.Errorf("callback_url %s: expected 400, got %d", callback, code)
+		}
+	}
+	_, completed := post(`{"expression": "1 + 2", "callback_url": "` + receiver.URL + `"}`)
+	_, failed := post(`{"expression": "1 / 0", "callback_url": "` + receiver.URL + `"}`)
+	runAgent(t, server.URL)
+	UserWebhooks = map[string]string{"alice": receiver.URL}
+	byDefault, _, _ := SubmitExpression(Submission{Expression: "7", Owner: "alice"})
+
+	deliveries := func(id string) []Delivery {
+		resp, err := http.Get(server.URL + "/api/v1/expressions/" + id + "/deliveries")
+		if err != nil {
+			t.Fatalf("GET deliveries: %v", err)
+		}
+		defer resp.Body.Close()
+		var list map[string][]Delivery
+		json.NewDecoder(resp.Body).Decode(&list)
+		return list["deliveries"]
+	}
+	for _, id := range []string{completed, failed, byDefault} {
+		var attempts []Delivery
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if attempts = deliveries(id); len(attempts) == 2 {
+				break
+			}
+		}
+		if len(attempts) != 2 || attempts[0].Delivered || attempts[0].StatusCode != http.StatusInternalServerError || !attempts[1].Delivered {
+			t.Errorf("%s: unexpected delivery log %+v", id, attempts)
+		}
+	}
+
+	// без разрешения доставка на внутренний адрес отклоняется при подключении
+	WebhookAllowedHosts = nil
+	webhookClient.CloseIdleConnections()
+	blocked, _, _ := SubmitExpression(Submission{Expression: "8", Owner: "alice"})
+	var attempts []Delivery
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if attempts = deliveries(blocked); len(attempts) == 5 {
+			break
+		}
+	}
+	if len(attempts) != 5 || attempts[0].Delivered || attempts[0].StatusCode != 0 {
+		t.Errorf("internal address: unexpected delivery log %+v", attempts)
+	}
+
+	received.Lock()
+	defer received.Unlock()
+	statuses := map[string]string{}
+	for _, expr := range bodies {
+		statuses[expr.ID] = expr.Status
+	}
+	if statuses[completed] != "completed" || statuses[failed] != "error" || statuses[byDefault] != "completed" {
+		t.Errorf("unexpected webhook payloads %+v", bodies)
+	}
+}
+
+func TestExpressionListing(t *testing.T) {
+	testAgent()
+	db, err := database.NewDatabase(t.TempDir() + "/storage.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer Open(NewMemoryStore())
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.Local)
+	defer func() { now = time.Now }()
+
+	for name, s := range map[string]Store{"memory": NewMemoryStore(), "sqlite": NewSQLiteStore(db)} {
+		Open(s)
+		server := httptest.NewServer(NewRouter())
+		// выражения создаются с интервалом в минуту
+		current := start
+		now = func() time.Time { return current }
+		for _, expr := range []string{"1 + 1", "2 * 5", "7", "1 / 0", "3 - 1"} {
+			SubmitExpression(Submission{Expression: expr})
+			current = current.Add(time.Minute)
+		}
+		runAgent(t, server.URL)
+
+		list := func(query string) ([]string, string, int) {
+			resp, err := http.Get(server.URL + "/api/v1/expressions" + query)
+			if err != nil {
+				t.Fatalf("GET /api/v1/expressions%s: %v", query, err)
+			}
+			defer resp.Body.Close()
+			var page struct {
+				Expressions []Expression `json:"expressions"`
+				NextCursor  string       `json:"next_cursor"`
+			}
+			json.NewDecoder(resp.Body).Decode(&page)
+			var exprs []string
+			for _, expr := range page.Expressions {
+				exprs = append(exprs, expr.Expression)
+			}
+			return exprs, page.NextCursor, resp.StatusCode
+		}
+
+		tests := []struct {
+			query    string
+			expected string
+		}{
+			{"", "3 - 1, 1 / 0, 7, 2 * 5, 1 + 1"},
+			{"?order=asc", "1 + 1, 2 * 5, 7, 1 / 0, 3 - 1"},
+			{"?status=error", "1 / 0"},
+			{"?q=%2B", "1 + 1"},
+			{"?sort=result&order=asc", "1 + 1, 3 - 1, 7, 2 * 5"},
+			{"?min_result=3&max_result=7", "7"},
+			{"?from=" + start.Add(time.Minute).Format(time.RFC3339) + "&to=" + start.Add(3*time.Minute).Format(time.RFC3339), "7, 2 * 5"},
+		}
+		for _, test := range tests {
+			exprs, next, code := list(test.query)
+			if code != http.StatusOK || next != "" || strings.Join(exprs, ", ") != test.expected {
+				t.Errorf("%s %q: got %d %q (next %q), expected %q", name, test.query, code, strings.Join(exprs, ", "), next, test.expected)
+			}
+		}
+
+		// страницы по два выражения покрывают весь список без повторов
+		for _, sort := range []string{"created_at", "result"} {
+			var all []string
+			cursor := ""
+			for pages := 0; pages < 10; pages++ {
+				exprs, next, code := list("?limit=2&order=asc&sort=" + sort + "&cursor=" + cursor)
+				if code != http.StatusOK {
+					t.Fatalf("%s: page: expected 200, got %d", name, code)
+				}
+				all = append(all, exprs...)
+				if cursor = next; cursor == "" {
+					break
+				}
+			}
+			expected := map[string]string{"created_at": "1 + 1, 2 * 5, 7, 1 / 0, 3 - 1", "result": "1 + 1, 3 - 1, 7, 2 * 5"}[sort]
+			if strings.Join(all, ", ") != expected {
+				t.Errorf("%s: pages sorted by %s: got %q, expected %q", name, sort, strings.Join(all, ", "), expected)
+			}
+		}
+
+		_, next, _ := list("?limit=1")
+		for _, query := range []string{"?limit=0", "?limit=1000", "?sort=owner", "?order=up", "?from=yesterday", "?cursor=bad", "?sort=result&cursor=" + next} {
+			if _, _, code := list(query); code != http.StatusBadRequest {
+				t.Errorf("%s %q: expected 400, got %d", name, query, code)
+			}
+		}
+		server.Close()
+	}
+
+	Open(NewMemoryStore())
+	SubmitExpression(Submission{Expression: "1", Owner: "alice"})
+	SubmitExpression(Submission{Expression: "2", Owner: "bob"})
+	Auth = auth.NewAuth("secret")
+	defer func() { Auth = nil }()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+	token, _ := Auth.GenerateToken(1, "alice")
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/expressions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page map[string][]Expression
+	json.NewDecoder(resp.Body).Decode(&page)
+	if exprs := page["expressions"]; len(exprs) != 1 || exprs[0].Owner != "alice" {
+		t.Errorf("user must see only own expressions, got %+v", exprs)
+	}
+	if resp, _ := http.Get(server.URL + "/api/v1/expressions"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("listing without token: expected 401, got %d", resp.StatusCode)
+	}
+
+	// чужое выражение нельзя прочитать, отменить или удалить
+	bob, _, _ := SubmitExpression(Submission{Expression: "2 + 2", Owner: "bob"})
+	do := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/v1/expressions/" + bob},
+		{"POST", "/api/v1/expressions/" + bob + "/cancel"},
+		{"DELETE", "/api/v1/expressions/" + bob},
+	} {
+		if code := do(route.method, route.path, ""); code != http.StatusUnauthorized {
+			t.Errorf("%s %s without token: expected 401, got %d", route.method, route.path, code)
+		}
+		if code := do(route.method, route.path, token); code != http.StatusNotFound {
+			t.Errorf("%s %s by another user: expected 404, got %d", route.method, route.path, code)
+		}
+	}
+	if expr, _ := GetExpressionByID(bob); expr.Status != statusPending {
+		t.Errorf("expression of bob must stay pending, got %s", expr.Status)
+	}
+	bobToken, _ := Auth.GenerateToken(2, "bob")
+	if code := do("POST", "/api/v1/expressions/"+bob+"/cancel", bobToken); code != http.StatusOK {
+		t.Errorf("owner cancel: expected 200, got %d", code)
+	}
+}
+
+func TestBatchSubmission(t *testing.T) {
+	testAgent()
+	db, err := database.NewDatabase(t.TempDir() + "/storage.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Open(NewSQLiteStore(db)); err != nil {
+		t.Fatal(err)
+	}
+	defer Open(NewMemoryStore())
+	defer func(size int) { MaxBatchSize = size }(MaxBatchSize)
+	MaxBatchSize = 3
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	post := func(body string) (int, string, []BatchResult) {
+		resp, err := http.Post(server.URL+"/api/v1/calculate/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /api/v1/calculate/batch: %v", err)
+		}
+		defer resp.Body.Close()
+		var created struct {
+			BatchID string        `json:"batch_id"`
+			Items   []BatchResult `json:"items"`
+		}
+		json.NewDecoder(resp.Body).Decode(&created)
+		return resp.StatusCode, created.BatchID, created.Items
+	}
+	getBatch := func(id string) (int, BatchStatus, []Expression) {
+		resp, err := http.Get(server.URL + "/api/v1/batches/" + id)
+		if err != nil {
+			t.Fatalf("GET /api/v1/batches/%s: %v", id, err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Batch       BatchStatus  `json:"batch"`
+			Expressions []Expression `json:"expressions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Batch, body.Expressions
+	}
+
+	code, id, items := post(`{"items": [
+		{"ref": "a", "expression": "x * (x + 1)", "variables": {"x": 3}},
+		{"ref": "b", "expression": "2 +"},
+		{"ref": "c", "expression": "7"}
+	]}`)
+	if code != http.StatusCreated || id == "" || len(items) != 3 {
+		t.Fatalf("batch: got %d %q %+v", code, id, items)
+	}
+	if items[0].Ref != "a" || items[0].ID == "" || items[1].Ref != "b" || items[1].Error == "" || items[1].ID != "" || items[2].ID == "" {
+		t.Errorf("unexpected item results %+v", items)
+	}
+
+	if code, status, _ := getBatch(id); code != http.StatusOK || status.Status != "in_progress" || status.Size != 3 || status.Rejected != 1 ||
+		status.Counts["pending"] != 1 || status.Counts["completed"] != 1 {
+		t.Errorf("batch before evaluation: got %d %+v", code, status)
+	}
+	// переменные выражения переживают перезапуск оркестратора
+	if err := Open(NewSQLiteStore(db)); err != nil {
+		t.Fatal(err)
+	}
+	runAgent(t, server.URL)
+	code, status, exprs := getBatch(id)
+	if code != http.StatusOK || status.Status != "completed" || status.Counts["completed"] != 2 {
+		t.Errorf("evaluated batch: got %d %+v", code, status)
+	}
+	results := map[string]string{}
+	for _, expr := range exprs {
+		if expr.BatchID != id || expr.Result == nil {
+			t.Fatalf("unexpected batch expression %+v", expr)
+		}
+		results[expr.Ref] = *expr.Result
+	}
+	if results["a"] != "12" || results["c"] != "7" || len(results) != 2 {
+		t.Errorf("unexpected batch results %v", results)
+	}
+
+	for body, expected := range map[string]int{
+		`{"items": []}`: http.StatusBadRequest,
+		`{"items": [{"expression": "1"}, {"expression": "2"}, {"expression": "3"}, {"expression": "4"}]}`: http.StatusRequestEntityTooLarge,
+		`{"items": [{"expression": "1"}], "priority": 10}`:                                                http.StatusBadRequest,
+		`{"items": `: http.StatusBadRequest,
+	} {
+		if code, _, _ := post(body); code != expected {
+			t.Errorf("%s: expected %d, got %d", body, expected, code)
+		}
+	}
+	if code, _, _ := getBatch("missing"); code != http.StatusNotFound {
+		t.Errorf("unknown batch: expected 404, got %d", code)
+	}
+
+	// выражения не создаются, если пакет не сохранен
+	Open(failingStore{Store: NewMemoryStore(), batch: true})
+	if _, _, err := SubmitBatch(Submission{}, []BatchItem{{Expression: "1 + 1"}}); err == nil {
+		t.Error("expected error when the batch cannot be saved")
+	}
+	if exprs := GetExpressions(); len(exprs) != 0 {
+		t.Errorf("expressions must not outlive a failed batch, got %+v", exprs)
+	}
+	// ошибка запуска выражения попадает в результат его элемента
+	Open(failingStore{Store: NewMemoryStore(), tasks: true})
+	_, items, err = SubmitBatch(Submission{}, []BatchItem{{Ref: "a", Expression: "1 + 1"}, {Ref: "b", Expression: "7"}})
+	if err != nil || items[0].Error == "" || items[1].Error != "" || items[1].ID == "" {
+		t.Errorf("expected a start error for item a only, got %+v, %v", items, err)
+	}
+}
+
+// failingStore отказывает в сохранении пакетов или задач.
+type failingStore struct {
+	Store
+	batch, tasks bool
+}
+
+func (s failingStore) CreateBatch(batch Batch) error {
+	if s.batch {
+		return errors.New("batch store failure")
+	}
+	return s.Store.CreateBatch(batch)
+}
+
+func (s failingStore) SaveTask(task TaskRecord) error {
+	if s.tasks {
+		return errors.New("task store failure")
+	}
+	return s.Store.SaveTask(task)
+}
+
+func TestResultCache(t *testing.T) {
+	testAgent()
+	ResultCache = calculator.NewCache(100, time.Hour)
+	defer func() { ResultCache, AdminToken = nil, "" }()
+	Open(NewMemoryStore())
+	defer Open(NewMemoryStore())
+
+	submitExpr := func(expression string) string {
+		id, _, err := SubmitExpression(Submission{Expression: expression})
+		if err != nil {
+			t.Fatalf("SubmitExpression(%q): %v", expression, err)
+		}
+		return id
+	}
+	// execute выполняет задачи из очереди и возвращает их операции
+	execute := func() []string {
+		var operations []string
+		for {
+			task, ok, _ := NextTask(testAgent())
+			if !ok {
+				return operations
+			}
+			value, _ := calculator.DefaultRegistry.Apply(task.Operation, calculator.Number(task.Arg1), calculator.Number(task.Arg2))
+			result, _ := value.Float()
+			if err := SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: result}); err != nil {
+				t.Fatal(err)
+			}
+			operations = append(operations, task.Operation)
+		}
+	}
+	result := func(id string) string {
+		expr, _ := GetExpressionByID(id)
+		if expr.Status != statusCompleted || expr.Result == nil {
+			return expr.Status
+		}
+		return *expr.Result
+	}
+
+	// общие подвыражения двух выражений выполняются одной задачей
+	first := submitExpr("(1 + 2) * 4")
+	second := submitExpr("4 * (2+1) - 1")
+	if operations := strings.Join(execute(), " "); operations != "+ * -" {
+		t.Errorf("expected tasks + * -, got %q", operations)
+	}
+	if result(first) != "12" || result(second) != "11" {
+		t.Errorf("got results %s and %s, expected 12 and 11", result(first), result(second))
+	}
+	// результат целиком берется из кэша
+	if cached := submitExpr("(2 + 1) * 4"); result(cached) != "12" {
+		t.Errorf("cached expression: got %s, expected 12", result(cached))
+	}
+	// подвыражения с rand() не кэшируются и не объединяются
+	submitExpr("rand() + 1")
+	submitExpr("rand() + 1")
+	if operations := strings.Join(execute(), " "); operations != "+ +" {
+		t.Errorf("expected two tasks for rand() + 1, got %q", operations)
+	}
+
+	// после отмены владельца задачи ждущее выражение получает свою задачу
+	owner := submitExpr("5 + 5")
+	waiter := submitExpr("(5 + 5) * 2")
+	if _, err := CancelExpression(owner); err != nil {
+		t.Fatal(err)
+	}
+	task, ok, _ := NextTask(testAgent())
+	if ref, _ := parseTaskID(task.ID); !ok || ref.exprID != waiter {
+		t.Fatalf("expected a task of the waiting expression, got %+v", task)
+	}
+	SubmitResult(agent.Result{ID: task.ID, LeaseID: task.LeaseID, Result: 10})
+	execute()
+	if result(waiter) != "20" {
+		t.Errorf("waiting expression: got %s, expected 20", result(waiter))
+	}
+
+	AdminToken = "admin"
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/admin/cache", nil)
+	req.Header.Set("X-Admin-Token", "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/v1/admin/cache: %v %v", err, resp)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Cache  calculator.CacheStats `json:"cache"`
+		Shared int                   `json:"shared_tasks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&stats)
+	if stats.Shared != 3 || stats.Cache.Hits == 0 || stats.Cache.HitRate <= 0 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
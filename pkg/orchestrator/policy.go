@@ -0,0 +1,105 @@
+package orchestrator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Policy определяет, какую из готовых задач получит агент.
+type Policy string
+
+const (
+	// PolicyFIFO выдает сначала задачи с большим приоритетом, а задачи
+	// одного приоритета — в порядке поступления, независимо от пользователя.
+	PolicyFIFO Policy = "fifo"
+	// PolicyFair делит агентов между пользователями пропорционально их
+	// весам. Приоритет упорядочивает только задачи одного пользователя и
+	// выбирает между пользователями с равным виртуальным временем, поэтому
+	// срочные выражения одного пользователя не останавливают остальных.
+	PolicyFair Policy = "fair"
+)
+
+// SchedulingPolicy — политика выдачи задач.
+var SchedulingPolicy = PolicyFair
+
+// UserWeights задает веса пользователей для PolicyFair: пользователь с весом
+// 2 получает вдвое больше задач, чем пользователь с весом 1. Вес по
+// умолчанию — 1.
+var UserWeights = map[string]float64{}
+
+// ParsePolicy разбирает название политики: fifo или fair.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyFIFO, PolicyFair:
+		return p, nil
+	}
+	return "", fmt.Errorf("Неизвестная политика планирования %q", s)
+}
+
+// ParseWeights разбирает веса пользователей вида "alice=3,bob=0.5".
+func ParseWeights(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		user, value, ok := strings.Cut(part, "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("Неверный вес пользователя %q", part)
+		}
+		weights[strings.TrimSpace(user)] = weight
+	}
+	return weights, nil
+}
+
+// fairness — состояние взвешенной справедливой очереди (start-time fair
+// queuing). Каждая выданная задача сдвигает виртуальное время окончания
+// пользователя на 1/вес; следующую задачу получает пользователь, чья
+// очередная задача раньше всех начинается в виртуальном времени. Простаивавший
+// пользователь начинает с текущего виртуального времени и не копит запас.
+type fairness struct {
+	virtual float64
+	finish  map[string]float64
+}
+
+var fair = newFairness()
+
+func newFairness() *fairness {
+	return &fairness{finish: map[string]float64{}}
+}
+
+func (f *fairness) start(owner string) float64 {
+	return math.Max(f.virtual, f.finish[owner])
+}
+
+// charge учитывает задачу, выданную пользователю owner.
+func (f *fairness) charge(owner string) {
+	weight := UserWeights[owner]
+	if weight <= 0 {
+		weight = 1
+	}
+	f.virtual = f.start(owner)
+	f.finish[owner] = f.virtual + 1/weight
+}
+
+// pick выбирает задачу среди первых задач очередей пользователей.
+func (f *fairness) pick(heads []TaskRecord) TaskRecord {
+	best := heads[0]
+	for _, task := range heads[1:] {
+		if SchedulingPolicy == PolicyFair {
+			if s, b := f.start(task.Owner), f.start(best.Owner); s != b {
+				if s < b {
+					best = task
+				}
+				continue
+			}
+		}
+		if task.before(best) {
+			best = task
+		}
+	}
+	return best
+}
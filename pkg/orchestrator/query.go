@@ -0,0 +1,99 @@
+package orchestrator
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/terlyne/go-calculator/internal/database"
+)
+
+// QueryExpressions возвращает страницу выражений по запросу q и курсор
+// следующей страницы; пустой курсор означает последнюю страницу. Непустой
+// owner оставляет только выражения этого пользователя.
+func QueryExpressions(owner *string, q database.ExpressionQuery) ([]Expression, string, error) {
+	return store.QueryExpressions(owner, q)
+}
+
+// resultNumber возвращает результат выражения как число; результаты другого
+// вида (даты, списки) и невычисленные выражения числа не имеют.
+func resultNumber(expr Expression) (float64, bool) {
+	if expr.Result == nil {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(*expr.Result, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// cursor указывает на выражение в порядке сортировки sort.
+func (expr Expression) cursor(sort string) database.Cursor {
+	result, _ := resultNumber(expr)
+	return database.NewCursor(sort, expr.CreatedAt, result, expr.ID)
+}
+
+// compare сравнивает выражение с позицией курсора c в порядке возрастания.
+func (expr Expression) compare(c database.Cursor) int {
+	key := 0
+	if c.Sort == database.SortResult {
+		value, _ := c.Result()
+		result, _ := resultNumber(expr)
+		if result < value {
+			key = -1
+		} else if result > value {
+			key = 1
+		}
+	} else {
+		value, _ := c.CreatedAt()
+		key = expr.CreatedAt.Compare(value)
+	}
+	if key != 0 {
+		return key
+	}
+	return strings.Compare(expr.ID, c.ID)
+}
+
+// matches сообщает, что выражение проходит фильтры запроса.
+func matches(expr Expression, owner *string, q database.ExpressionQuery) bool {
+	if owner != nil && expr.Owner != *owner || q.Status != "" && expr.Status != q.Status {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && expr.CreatedAt.Before(q.CreatedFrom) ||
+		!q.CreatedTo.IsZero() && !expr.CreatedAt.Before(q.CreatedTo) {
+		return false
+	}
+	if !strings.Contains(expr.Expression, q.Contains) {
+		return false
+	}
+	result, ok := resultNumber(expr)
+	if (q.ResultMin != nil || q.ResultMax != nil || q.Sort == database.SortResult) && !ok {
+		return false
+	}
+	return (q.ResultMin == nil || result >= *q.ResultMin) && (q.ResultMax == nil || result <= *q.ResultMax)
+}
+
+// page отбирает, сортирует и разбивает на страницы выражения в памяти.
+func page(exprs []Expression, owner *string, q database.ExpressionQuery) ([]Expression, string) {
+	sign := 1
+	if q.Desc {
+		sign = -1
+	}
+	var result []Expression
+	for _, expr := range exprs {
+		if !matches(expr, owner, q) {
+			continue
+		}
+		if q.After != nil && sign*expr.compare(*q.After) <= 0 {
+			continue
+		}
+		result = append(result, expr)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return sign*result[i].compare(result[j].cursor(q.Sort)) < 0
+	})
+	if q.Limit <= 0 || len(result) <= q.Limit {
+		return result, ""
+	}
+	result = result[:q.Limit]
+	return result, result[q.Limit-1].cursor(q.Sort).String()
+}
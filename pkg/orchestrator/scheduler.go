@@ -0,0 +1,687 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"maps"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/terlyne/go-calculator/pkg/agent"
+	"github.com/terlyne/go-calculator/pkg/calculator"
+)
+
+var (
+	errTaskNotFound       = errors.New("Задача не найдена")
+	errLeaseRequired      = errors.New("Не указана аренда задачи")
+	errStaleLease         = errors.New("Аренда задачи истекла или передана другому агенту")
+	errExpressionNotFound = errors.New("Выражение не найдено")
+	errExpressionFinished = errors.New("Выражение уже вычислено")
+	// errTaskCancelled сообщает агенту, что выражение отменено и задачу нужно бросить
+	errTaskCancelled = errors.New("Выражение отменено")
+	// errIdempotencyConflict — ключ идемпотентности уже использован для другого выражения
+	errIdempotencyConflict = errors.New("Ключ идемпотентности использован для другого выражения")
+	errInvalidPriority     = errors.New("Приоритет должен быть от 0 до 9")
+)
+
+// MaxPriority — наибольший приоритет выражения; по умолчанию приоритет 0.
+const MaxPriority = 9
+
+// Состояния выражения: pending — ни одна задача еще не выдана агентам,
+// in_progress — агенты выполняют задачи выражения.
+const (
+	statusPending    = "pending"
+	statusInProgress = "in_progress"
+	statusCompleted  = "completed"
+	statusError      = "error"
+	statusCancelled  = "cancelled"
+	// statusUnroutable — ни один зарегистрированный агент не умеет выполнять
+	// операцию выражения
+	statusUnroutable = "unroutable"
+)
+
+// active сообщает, что выражение еще вычисляется.
+func active(status string) bool {
+	return status == statusPending || status == statusInProgress
+}
+
+// Состояния задачи.
+const (
+	taskQueued     = "queued"
+	taskInProgress = "in_progress"
+	taskDone       = "done"
+)
+
+// LeaseTimeout — время, за которое агент должен вернуть результат задачи.
+// После него задача возвращается в очередь и может быть выдана другому агенту.
+var LeaseTimeout = 30 * time.Second
+
+// OperationTimes задает имитируемое время выполнения операций по символу
+// или имени; агент получает его в задаче как operation_time. Префиксный
+// оператор с символом инфиксного (унарный минус) задается ключом
+// "unary" + символ, например "unary-".
+var OperationTimes = map[string]time.Duration{}
+
+// IdempotencyWindow — сколько хранится связь ключа Idempotency-Key с
+// созданным по нему выражением.
+var IdempotencyWindow = 24 * time.Hour
+
+// now — источник текущего времени; подменяется в тестах.
+var now = time.Now
+
+// job — выражение, разложенное на операции. Каждая операция — задача для
+// агента; задача становится готовой, когда вычислены все ее аргументы.
+// Задачи и результаты хранятся в store, а job восстанавливается по ним после
+// перезапуска.
+type job struct {
+	expr       Expression
+	graph      *calculator.Graph
+	done       []bool
+	results    []calculator.Value
+	waiting    []int
+	dependents [][]int
+	// keys — канонические ключи узлов для ResultCache и inflight
+	keys []string
+	// seeds — начальные значения генераторов недетерминированных узлов
+	seeds map[int]int64
+	// recovered — задачи, найденные в хранилище при восстановлении
+	recovered map[int]TaskRecord
+}
+
+var (
+	store Store = NewMemoryStore()
+	// jobs — незавершенные выражения
+	jobs = make(map[string]*job)
+)
+
+// taskRef указывает на узел графа выражения; ID задачи имеет вид <id выражения>.0.
+type taskRef struct {
+	exprID string
+	node   int
+}
+
+func (t taskRef) id() string {
+	return t.exprID + "." + strconv.Itoa(t.node)
+}
+
+func parseTaskID(id string) (taskRef, bool) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return taskRef{}, false
+	}
+	node, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return taskRef{}, false
+	}
+	return taskRef{exprID: id[:i], node: node}, true
+}
+
+// Open переключает оркестратор на хранилище s и продолжает вычисление
+// незавершенных выражений: принятые результаты задач подставляются заново,
+// задачи в очереди и у агентов остаются как есть.
+func Open(s Store) error {
+	mu.Lock()
+	defer mu.Unlock()
+	store = s
+	jobs = make(map[string]*job)
+	inflight = make(map[string]*flight)
+	fair = newFairness()
+
+	exprs, err := s.ListExpressions()
+	if err != nil {
+		return err
+	}
+	for _, expr := range exprs {
+		if !active(expr.Status) {
+			continue
+		}
+		graph, err := plan(expr)
+		if err != nil {
+			expr.Status, expr.Error = statusError, err.Error()
+			if err := s.UpdateExpression(expr); err != nil {
+				return err
+			}
+			continue
+		}
+		tasks, err := s.ListTasks(expr.ID)
+		if err != nil {
+			return err
+		}
+		j := newJob(expr, graph)
+		j.recovered = make(map[int]TaskRecord, len(tasks))
+		for _, task := range tasks {
+			j.recovered[task.Node] = task
+			if task.Status == taskInProgress {
+				notifyAt(task.Deadline)
+			}
+		}
+		if err := j.start(); err != nil {
+			return err
+		}
+		j.recovered = nil
+	}
+	return nil
+}
+
+func newJob(expr Expression, graph *calculator.Graph) *job {
+	n := len(graph.Nodes)
+	j := &job{
+		expr:       expr,
+		graph:      graph,
+		done:       make([]bool, n),
+		results:    make([]calculator.Value, n),
+		waiting:    make([]int, n),
+		dependents: graph.Dependents(),
+		keys:       graph.Keys(),
+		seeds:      make(map[int]int64),
+	}
+	// генератор выражения раздает значения узлам в порядке их номеров, поэтому
+	// результат не зависит от того, в каком порядке агенты вернут аргументы,
+	// и повторяется после перезапуска
+	rng := mathrand.New(mathrand.NewSource(expr.Seed))
+	for _, node := range graph.Nodes {
+		if !node.Pure {
+			j.seeds[node.ID] = rng.Int63()
+		}
+	}
+	jobs[expr.ID] = j
+	return j
+}
+
+// start планирует узлы, не зависящие от других.
+func (j *job) start() error {
+	if j.graph.Result.Literal {
+		return j.complete(j.graph.Result.Value)
+	}
+	var ready []int
+	for _, node := range j.graph.Nodes {
+		j.waiting[node.ID] = len(node.DependsOn)
+		if j.waiting[node.ID] == 0 {
+			ready = append(ready, node.ID)
+		}
+	}
+	for _, node := range ready {
+		if err := j.schedule(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Submission — выражение, отправленное на вычисление.
+type Submission struct {
+	Expression string
+	// Owner — пользователь, отправивший выражение; пустой у анонимных отправок
+	Owner string
+	// Priority — от 0 до MaxPriority; задачи выражений с большим приоритетом
+	// выдаются агентам раньше
+	Priority int
+	// IdempotencyKey делает отправку идемпотентной: в течение
+	// IdempotencyWindow повторная отправка с тем же ключом возвращает уже
+	// созданное выражение. Ключи разных пользователей не пересекаются.
+	IdempotencyKey string
+	// CallbackURL получает вебхук, когда выражение вычислено или
+	// завершилось ошибкой; без него используется вебхук из UserWebhooks
+	CallbackURL string
+	// Variables — значения переменных выражения
+	Variables map[string]float64
+	// Ref — ссылка клиента на выражение пакета
+	Ref string
+	// Seed задает генератор случайных функций; без него выбирается случайно
+	Seed *int64
+}
+
+// SubmitExpression разбирает выражение на операции и ставит в очередь те,
+// что не зависят от других. Возвращает идентификатор выражения и признак
+// replayed, если выражение уже было создано с тем же ключом идемпотентности;
+// ключ, использованный для другого выражения, дает errIdempotencyConflict.
+func SubmitExpression(sub Submission) (id string, replayed bool, err error) {
+	if err := sub.validate(); err != nil {
+		return "", false, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// ключ хранится вместе с пользователем, чтобы ключи разных пользователей не совпадали
+	key := ""
+	if sub.IdempotencyKey != "" {
+		key = sub.Owner + "\x00" + sub.IdempotencyKey
+		id, ok, err := store.GetIdempotencyKey(key, now())
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			expr, _, err := store.GetExpression(id)
+			if err != nil {
+				return "", false, err
+			}
+			if expr.Expression != sub.Expression || !maps.Equal(expr.Variables, sub.Variables) ||
+				sub.Seed != nil && *sub.Seed != expr.Seed {
+				return "", false, errIdempotencyConflict
+			}
+			return id, true, nil
+		}
+	}
+
+	j, err := createExpression(sub, "")
+	if err != nil {
+		return "", false, err
+	}
+	if key != "" {
+		if err := store.SaveIdempotencyKey(key, j.expr.ID, now(), now().Add(IdempotencyWindow)); err != nil {
+			return "", false, err
+		}
+	}
+	return j.expr.ID, false, j.start()
+}
+
+// validate проверяет параметры отправки, не зависящие от выражения.
+func (sub Submission) validate() error {
+	if sub.Priority < 0 || sub.Priority > MaxPriority {
+		return errInvalidPriority
+	}
+	if sub.CallbackURL != "" && !validCallback(sub.CallbackURL) {
+		return errInvalidCallback
+	}
+	return nil
+}
+
+// createExpression разбирает и сохраняет выражение пакета batchID (пустой — без
+// пакета). Вызывающий запускает вычисление через start.
+func createExpression(sub Submission, batchID string) (*job, error) {
+	seed := newSeed()
+	if sub.Seed != nil {
+		seed = *sub.Seed
+	}
+	expr := Expression{
+		ID:          newID(),
+		Expression:  sub.Expression,
+		Variables:   sub.Variables,
+		Status:      statusPending,
+		CreatedAt:   now(),
+		Owner:       sub.Owner,
+		Priority:    sub.Priority,
+		CallbackURL: sub.CallbackURL,
+		BatchID:     batchID,
+		Ref:         sub.Ref,
+		Seed:        seed,
+	}
+	graph, err := plan(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CreateExpression(expr); err != nil {
+		return nil, err
+	}
+	j := newJob(expr, graph)
+	publish(j.event(eventStatus, ""))
+	return j, nil
+}
+
+// plan раскладывает выражение на операции с его переменными.
+func plan(expr Expression) (*calculator.Graph, error) {
+	vars := make(map[string]calculator.Value, len(expr.Variables))
+	for name, value := range expr.Variables {
+		vars[name] = calculator.Number(value)
+	}
+	return calculator.PlanWithOptions(expr.Expression, calculator.Options{Vars: vars})
+}
+
+// schedule подставляет аргументы готового узла и отдает его агентам. Узлы,
+// которые нельзя передать агенту числами (даты, списки, точные целые,
+// недетерминированные функции), оркестратор выполняет сам. Результат чистого
+// узла берется из ResultCache или из задачи с тем же ключом, которую уже
+// выполняют для другого выражения.
+func (j *job) schedule(node int) error {
+	if !active(j.expr.Status) {
+		return nil
+	}
+	if task, ok := j.recovered[node]; ok {
+		if task.Status == taskDone {
+			return j.resolve(node, calculator.Number(task.Result))
+		}
+		// задача уже стоит в очереди или выполняется агентом
+		j.own(node)
+		return nil
+	}
+	if done, err := j.reuse(node); done || err != nil {
+		return err
+	}
+
+	n := j.graph.Nodes[node]
+	args := make([]calculator.Value, len(n.Operands))
+	floats := make([]float64, len(n.Operands))
+	distributable := calculator.DefaultRegistry.Distributable(n.Operation, len(args))
+	for i, operand := range n.Operands {
+		args[i] = operand.Value
+		if !operand.Literal {
+			args[i] = j.results[operand.Node]
+		}
+		var ok bool
+		if floats[i], ok = args[i].PlainFloat(); !ok {
+			distributable = false
+		}
+	}
+
+	if distributable {
+		if !routable(n.Operation) {
+			return j.finish(statusUnroutable, unroutableMessage(n.Operation))
+		}
+		defer taskReady.notify()
+		j.own(node)
+		return store.SaveTask(TaskRecord{
+			ID:        taskRef{exprID: j.expr.ID, node: node}.id(),
+			ExprID:    j.expr.ID,
+			Node:      node,
+			Operation: n.Operation,
+			Args:      floats,
+			Status:    taskQueued,
+			Owner:     j.expr.Owner,
+			Priority:  j.expr.Priority,
+			Mode:      operationMode(n.Operation),
+		})
+	}
+	var opts calculator.Options
+	if seed, ok := j.seeds[node]; ok {
+		opts.Seed = &seed
+	}
+	result, err := calculator.DefaultRegistry.ApplyWithOptions(opts, n.Operation, args...)
+	if err != nil {
+		return j.fail(err.Error())
+	}
+	return j.resolve(node, result)
+}
+
+// resolve сохраняет результат узла и планирует зависящие от него узлы.
+func (j *job) resolve(node int, result calculator.Value) error {
+	if j.done[node] || !active(j.expr.Status) {
+		return nil
+	}
+	j.done[node] = true
+	j.results[node] = result
+	publish(j.event(eventTask, taskRef{exprID: j.expr.ID, node: node}.id()))
+	if err := j.shareResult(node, result); err != nil {
+		return err
+	}
+	if !j.graph.Result.Literal && j.graph.Result.Node == node {
+		return j.complete(result)
+	}
+	for _, dependent := range j.dependents[node] {
+		j.waiting[dependent]--
+		if j.waiting[dependent] == 0 {
+			if err := j.schedule(dependent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (j *job) complete(result calculator.Value) error {
+	value := result.String()
+	j.expr.Status = statusCompleted
+	j.expr.Result = &value
+	delete(jobs, j.expr.ID)
+	publish(j.event(eventStatus, ""))
+	if err := store.UpdateExpression(j.expr); err != nil {
+		return err
+	}
+	notifyWebhook(j.expr)
+	return nil
+}
+
+func (j *job) fail(message string) error {
+	return j.finish(statusError, message)
+}
+
+// finish завершает выражение без результата со статусом status.
+func (j *job) finish(status, message string) error {
+	j.expr.Status = status
+	j.expr.Error = message
+	delete(jobs, j.expr.ID)
+	publish(j.event(eventStatus, ""))
+	if err := store.UpdateExpression(j.expr); err != nil {
+		return err
+	}
+	notifyWebhook(j.expr)
+	return j.release()
+}
+
+// timeKey возвращает ключ задачи в OperationTimes: префиксный оператор,
+// символ которого есть и у инфиксного, отличается от него приставкой unary.
+func (t TaskRecord) timeKey() string {
+	if len(t.Args) == 1 {
+		if _, infix := calculator.DefaultRegistry.Operator(t.Operation, false); infix {
+			return "unary" + t.Operation
+		}
+	}
+	return t.Operation
+}
+
+// agentTask описывает задачу для агента: два аргумента передаются в Arg1 и
+// Arg2, остальные количества — в Args.
+func (t TaskRecord) agentTask() agent.Task {
+	task := agent.Task{
+		ID:            t.ID,
+		Operation:     t.Operation,
+		LeaseID:       t.LeaseID,
+		OperationTime: OperationTimes[t.timeKey()].Milliseconds(),
+	}
+	if t.Mode != agent.ModeFloat {
+		task.Mode = t.Mode
+	}
+	if len(t.Args) == 2 {
+		task.Arg1, task.Arg2 = t.Args[0], t.Args[1]
+	} else {
+		task.Args = t.Args
+	}
+	deadline := t.Deadline
+	task.LeaseDeadline = &deadline
+	return task
+}
+
+// NextTask выдает агенту agentID следующую задачу в аренду на LeaseTimeout.
+// Задача выбирается по приоритету и SchedulingPolicy; задачи с истекшей
+// арендой выдаются повторно. Задачи получают только зарегистрированные
+// агенты: пустой или неизвестный agentID дает errAgentNotFound.
+func NextTask(agentID string) (agent.Task, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := evictSilent(); err != nil {
+		return agent.Task{}, false, err
+	}
+	state, ok := agents[agentID]
+	if !ok {
+		return agent.Task{}, false, errAgentNotFound
+	}
+	state.info.LastSeen = now()
+	// агент получает только задачи, которые умеет выполнять
+	heads, err := store.QueueHeads(now(), state.info.Operations, agentModes(state.info.Modes))
+	if err != nil || len(heads) == 0 {
+		return agent.Task{}, false, err
+	}
+	next := fair.pick(heads)
+	task, ok, err := store.ClaimTask(next.ID, agentID, now(), newLeaseID(), now().Add(LeaseTimeout))
+	if err != nil || !ok {
+		return agent.Task{}, false, err
+	}
+	fair.charge(task.Owner)
+	notifyAt(task.Deadline)
+	// первая выданная задача переводит выражение в in_progress
+	if j, ok := jobs[task.ExprID]; ok && j.expr.Status == statusPending {
+		j.expr.Status = statusInProgress
+		if err := store.UpdateExpression(j.expr); err != nil {
+			return agent.Task{}, false, err
+		}
+		publish(j.event(eventStatus, ""))
+	}
+	return task.agentTask(), true, nil
+}
+
+// SubmitResult принимает результат задачи от агента. Результат должен
+// предъявить действующую аренду; повторная отправка результата по той же
+// аренде ничего не меняет, а результат по истекшей или чужой аренде
+// отклоняется с errStaleLease. Ошибка операции завершает все выражение.
+func SubmitResult(result agent.Result) error {
+	if _, ok := parseTaskID(result.ID); !ok {
+		return errTaskNotFound
+	}
+	if result.LeaseID == "" {
+		return errLeaseRequired
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	task, ok, err := store.GetTask(result.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errTaskNotFound
+	}
+	if task.LeaseID != result.LeaseID {
+		return errStaleLease
+	}
+	if task.Status != taskInProgress {
+		// результат по этой аренде уже принят
+		return nil
+	}
+	if err := checkActive(task.ExprID); err != nil {
+		return err
+	}
+	task.Status = taskDone
+	task.Result = result.Result
+	if err := store.SaveTask(task); err != nil {
+		return err
+	}
+	touchAgent(task.AgentID)
+	recordFinished(task.AgentID, result.Error != "")
+
+	j, ok := jobs[task.ExprID]
+	if !ok {
+		return nil
+	}
+	if result.Error != "" {
+		return j.fail(result.Error)
+	}
+	return j.resolve(task.Node, calculator.Number(result.Result))
+}
+
+func newLeaseID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newSeed() int64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return int64(binary.BigEndian.Uint64(b) >> 1)
+}
+
+// Heartbeat продлевает аренду задачи, которую выполняет агент, еще на
+// LeaseTimeout. Если выражение отменено, возвращает errTaskCancelled: агент
+// должен бросить задачу.
+func Heartbeat(taskID, leaseID string) (time.Time, error) {
+	if leaseID == "" {
+		return time.Time{}, errLeaseRequired
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	task, ok, err := store.GetTask(taskID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, errTaskNotFound
+	}
+	if task.LeaseID != leaseID || task.Status != taskInProgress {
+		return time.Time{}, errStaleLease
+	}
+	if err := checkActive(task.ExprID); err != nil {
+		return time.Time{}, err
+	}
+	touchAgent(task.AgentID)
+	task.Deadline = now().Add(LeaseTimeout)
+	if err := store.SaveTask(task); err != nil {
+		return time.Time{}, err
+	}
+	notifyAt(task.Deadline)
+	return task.Deadline, nil
+}
+
+// CancelExpression останавливает вычисление выражения: его задачи больше не
+// выдаются, а агенты, выполняющие их, получают errTaskCancelled при
+// следующем продлении аренды или отправке результата. Повторная отмена
+// ничего не меняет.
+func CancelExpression(id string) (Expression, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	expr, ok, err := store.GetExpression(id)
+	if err != nil {
+		return Expression{}, err
+	}
+	if !ok {
+		return Expression{}, errExpressionNotFound
+	}
+	switch expr.Status {
+	case statusCancelled:
+		return expr, nil
+	case statusPending, statusInProgress:
+	default:
+		return expr, errExpressionFinished
+	}
+	j := jobs[id]
+	delete(jobs, id)
+	expr.Status = statusCancelled
+	if err := store.UpdateExpression(expr); err != nil {
+		return expr, err
+	}
+	publish(Event{Type: eventStatus, Expression: expr})
+	if j != nil {
+		return expr, j.release()
+	}
+	return expr, nil
+}
+
+// DeleteExpression отменяет выражение, если оно еще вычисляется, и удаляет
+// его вместе с задачами.
+func DeleteExpression(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	expr, ok, err := store.GetExpression(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errExpressionNotFound
+	}
+	j := jobs[id]
+	delete(jobs, id)
+	if err := store.DeleteExpression(id); err != nil {
+		return err
+	}
+	publish(Event{Type: eventDeleted, Expression: expr})
+	if j != nil {
+		return j.release()
+	}
+	return nil
+}
+
+// checkActive возвращает errTaskCancelled, если выражение задачи отменено
+// или удалено.
+func checkActive(exprID string) error {
+	if _, ok := jobs[exprID]; ok {
+		return nil
+	}
+	expr, ok, err := store.GetExpression(exprID)
+	if err != nil {
+		return err
+	}
+	if !ok || expr.Status == statusCancelled {
+		return errTaskCancelled
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package orchestrator
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/terlyne/go-calculator/internal/database"
+)
+
+var errExpressionExists = errors.New("Выражение с таким идентификатором уже существует")
+
+// TaskRecord — сохраняемое состояние задачи агента.
+type TaskRecord struct {
+	// ID имеет вид <id выражения>.<номер узла>
+	ID        string
+	ExprID    string
+	Node      int
+	Operation string
+	Args      []float64
+	Status    string
+	LeaseID   string
+	Deadline  time.Time
+	Result    float64
+	// Seq задает порядок поступления задач в очередь
+	Seq int64
+	// Owner и Priority копируются из выражения для планирования
+	Owner    string
+	Priority int
+	// AgentID — агент, которому выдана задача
+	AgentID string
+	// Mode — режим, который должен поддерживать агент
+	Mode string
+}
+
+// Store хранит выражения и задачи оркестратора.
+type Store interface {
+	// CreateExpression сохраняет новое выражение.
+	CreateExpression(expr Expression) error
+	// UpdateExpression сохраняет статус, результат и ошибку выражения.
+	UpdateExpression(expr Expression) error
+	GetExpression(id string) (Expression, bool, error)
+	// ListExpressions возвращает выражения в порядке создания.
+	ListExpressions() ([]Expression, error)
+	// QueryExpressions возвращает страницу выражений по запросу q и курсор
+	// следующей страницы; непустой owner оставляет выражения одного
+	// пользователя.
+	QueryExpressions(owner *string, q database.ExpressionQuery) ([]Expression, string, error)
+	// DeleteExpression удаляет выражение вместе с его задачами, ключами
+	// идемпотентности и журналом вебхуков.
+	DeleteExpression(id string) error
+
+	// SaveTask добавляет задачу или обновляет существующую; новой задаче
+	// назначается следующий Seq.
+	SaveTask(task TaskRecord) error
+	GetTask(id string) (TaskRecord, bool, error)
+	ListTasks(exprID string) ([]TaskRecord, error)
+	// QueueHeads возвращает для каждого пользователя первую задачу его
+	// очереди: задачу незавершенного выражения, которая стоит в очереди или
+	// чья аренда истекла к now, с наибольшим приоритетом и наименьшим Seq.
+	// Непустые operations и modes оставляют только задачи с этими
+	// операциями и режимами.
+	QueueHeads(now time.Time, operations, modes []string) ([]TaskRecord, error)
+	// ClaimTask выдает задачу в аренду агенту agentID, если к now ее еще
+	// можно выдать.
+	ClaimTask(id, agentID string, now time.Time, leaseID string, deadline time.Time) (TaskRecord, bool, error)
+	// AgentTasks возвращает задачи, которые выполняет агент.
+	AgentTasks(agentID string) ([]TaskRecord, error)
+
+	// GetIdempotencyKey возвращает выражение, созданное с ключом key, если
+	// срок действия ключа не истек к now.
+	GetIdempotencyKey(key string, now time.Time) (string, bool, error)
+	// SaveIdempotencyKey связывает ключ с выражением до expires и удаляет
+	// ключи, срок которых истек.
+	SaveIdempotencyKey(key, exprID string, now, expires time.Time) error
+
+	// CreateBatch сохраняет пакет выражений.
+	CreateBatch(batch Batch) error
+	GetBatch(id string) (Batch, bool, error)
+	// BatchExpressions возвращает выражения пакета в порядке создания.
+	BatchExpressions(batchID string) ([]Expression, error)
+
+	// SaveDelivery записывает попытку доставки вебхука.
+	SaveDelivery(d Delivery) error
+	// ListDeliveries возвращает попытки доставки вебхуков выражения в
+	// порядке их записи.
+	ListDeliveries(exprID string) ([]Delivery, error)
+}
+
+// claimable сообщает, что задачу можно выдать агенту в момент now.
+func claimable(task TaskRecord, now time.Time) bool {
+	return task.Status == taskQueued || task.Status == taskInProgress && now.After(task.Deadline)
+}
+
+// before сообщает, что задача a стоит в очереди раньше b: сначала больший
+// приоритет, затем более раннее поступление.
+func (a TaskRecord) before(b TaskRecord) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Seq < b.Seq
+}
+
+// MemoryStore хранит состояние в памяти процесса.
+type MemoryStore struct {
+	mu          sync.Mutex
+	expressions map[string]Expression
+	tasks       map[string]TaskRecord
+	// queue — задачи незавершенных выражений, которые стоят в очереди или
+	// выполняются, по выражениям; выполненные задачи и задачи завершенных
+	// выражений в нее не входят, чтобы QueueHeads не просматривал их
+	queue      map[string]map[string]struct{}
+	seq        int64
+	keys       map[string]idempotencyKey
+	deliveries map[string][]Delivery
+	batches    map[string]Batch
+}
+
+type idempotencyKey struct {
+	exprID  string
+	expires time.Time
+}
+
+// NewMemoryStore создает пустое хранилище в памяти.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{expressions: map[string]Expression{}, tasks: map[string]TaskRecord{}, queue: map[string]map[string]struct{}{}, keys: map[string]idempotencyKey{}, deliveries: map[string][]Delivery{}, batches: map[string]Batch{}}
+}
+
+func (s *MemoryStore) CreateExpression(expr Expression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.expressions[expr.ID]; exists {
+		return errExpressionExists
+	}
+	s.expressions[expr.ID] = expr
+	return nil
+}
+
+func (s *MemoryStore) UpdateExpression(expr Expression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expressions[expr.ID] = expr
+	if !active(expr.Status) {
+		delete(s.queue, expr.ID)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetExpression(id string) (Expression, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expr, ok := s.expressions[id]
+	return expr, ok, nil
+}
+
+func (s *MemoryStore) ListExpressions() ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Expression, 0, len(s.expressions))
+	for _, expr := range s.expressions {
+		result = append(result, expr)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) QueryExpressions(owner *string, q database.ExpressionQuery) ([]Expression, string, error) {
+	exprs, err := s.ListExpressions()
+	if err != nil {
+		return nil, "", err
+	}
+	result, next := page(exprs, owner, q)
+	return result, next, nil
+}
+
+func (s *MemoryStore) SaveTask(task TaskRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, exists := s.tasks[task.ID]; exists {
+		task.Seq = old.Seq
+	} else {
+		s.seq++
+		task.Seq = s.seq
+	}
+	s.tasks[task.ID] = task
+	s.enqueue(task)
+	return nil
+}
+
+// enqueue добавляет задачу в очередь или убирает из нее по статусам задачи
+// и ее выражения.
+func (s *MemoryStore) enqueue(task TaskRecord) {
+	queued := s.queue[task.ExprID]
+	if task.Status == taskDone || !active(s.expressions[task.ExprID].Status) {
+		delete(queued, task.ID)
+		if len(queued) == 0 {
+			delete(s.queue, task.ExprID)
+		}
+		return
+	}
+	if queued == nil {
+		queued = map[string]struct{}{}
+		s.queue[task.ExprID] = queued
+	}
+	queued[task.ID] = struct{}{}
+}
+
+func (s *MemoryStore) GetTask(id string) (TaskRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	return task, ok, nil
+}
+
+func (s *MemoryStore) ListTasks(exprID string) ([]TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []TaskRecord
+	for _, task := range s.tasks {
+		if task.ExprID == exprID {
+			result = append(result, task)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Seq < result[j].Seq })
+	return result, nil
+}
+
+func (s *MemoryStore) QueueHeads(now time.Time, operations, modes []string) ([]TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	heads := map[string]TaskRecord{}
+	for _, queued := range s.queue {
+		for id := range queued {
+			task := s.tasks[id]
+			if !claimable(task, now) {
+				continue
+			}
+			if len(operations) > 0 && !contains(operations, task.Operation) || len(modes) > 0 && !contains(modes, task.Mode) {
+				continue
+			}
+			if head, ok := heads[task.Owner]; !ok || task.before(head) {
+				heads[task.Owner] = task
+			}
+		}
+	}
+	result := make([]TaskRecord, 0, len(heads))
+	for _, task := range heads {
+		result = append(result, task)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].before(result[j]) })
+	return result, nil
+}
+
+func (s *MemoryStore) ClaimTask(id, agentID string, now time.Time, leaseID string, deadline time.Time) (TaskRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok || !claimable(task, now) {
+		return TaskRecord{}, false, nil
+	}
+	task.Status = taskInProgress
+	task.LeaseID = leaseID
+	task.Deadline = deadline
+	task.AgentID = agentID
+	s.tasks[id] = task
+	return task, true, nil
+}
+
+func (s *MemoryStore) AgentTasks(agentID string) ([]TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []TaskRecord
+	for _, task := range s.tasks {
+		if task.AgentID == agentID && task.Status == taskInProgress {
+			result = append(result, task)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Seq < result[j].Seq })
+	return result, nil
+}
+
+func (s *MemoryStore) GetIdempotencyKey(key string, now time.Time) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[key]
+	if !ok || !now.Before(k.expires) {
+		return "", false, nil
+	}
+	return k.exprID, true, nil
+}
+
+func (s *MemoryStore) SaveIdempotencyKey(key, exprID string, now, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.keys {
+		if !now.Before(v.expires) {
+			delete(s.keys, k)
+		}
+	}
+	s.keys[key] = idempotencyKey{exprID: exprID, expires: expires}
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpression(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expressions, id)
+	delete(s.queue, id)
+	for taskID, task := range s.tasks {
+		if task.ExprID == id {
+			delete(s.tasks, taskID)
+		}
+	}
+	for key, k := range s.keys {
+		if k.exprID == id {
+			delete(s.keys, key)
+		}
+	}
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *MemoryStore) CreateBatch(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[batch.ID] = batch
+	return nil
+}
+
+func (s *MemoryStore) GetBatch(id string) (Batch, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, ok := s.batches[id]
+	return batch, ok, nil
+}
+
+func (s *MemoryStore) BatchExpressions(batchID string) ([]Expression, error) {
+	exprs, err := s.ListExpressions()
+	if err != nil {
+		return nil, err
+	}
+	var result []Expression
+	for _, expr := range exprs {
+		if expr.BatchID == batchID {
+			result = append(result, expr)
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) SaveDelivery(d Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.ExprID] = append(s.deliveries[d.ExprID], d)
+	return nil
+}
+
+func (s *MemoryStore) ListDeliveries(exprID string) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Delivery(nil), s.deliveries[exprID]...), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
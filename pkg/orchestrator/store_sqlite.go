@@ -0,0 +1,364 @@
+package orchestrator
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/terlyne/go-calculator/internal/database"
+)
+
+// SQLiteStore хранит состояние оркестратора в базе SQLite сервиса, поэтому
+// выражения и задачи переживают перезапуск.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore использует подключение и таблицы, созданные internal/database.
+func NewSQLiteStore(db *database.Database) *SQLiteStore {
+	return &SQLiteStore{db: db.DB()}
+}
+
+const jobColumns = `id, expression, status, result, error, created_at, owner, priority, callback_url, variables, batch_id, ref, seed`
+
+func scanJob(row interface{ Scan(dest ...any) error }) (Expression, error) {
+	var expr Expression
+	var result sql.NullString
+	var variables string
+	err := row.Scan(&expr.ID, &expr.Expression, &expr.Status, &result, &expr.Error, &expr.CreatedAt, &expr.Owner, &expr.Priority, &expr.CallbackURL,
+		&variables, &expr.BatchID, &expr.Ref, &expr.Seed)
+	if err != nil {
+		return expr, err
+	}
+	if result.Valid {
+		expr.Result = &result.String
+	}
+	if variables != "" {
+		err = json.Unmarshal([]byte(variables), &expr.Variables)
+	}
+	return expr, err
+}
+
+func (s *SQLiteStore) CreateExpression(expr Expression) error {
+	variables := ""
+	if len(expr.Variables) > 0 {
+		data, err := json.Marshal(expr.Variables)
+		if err != nil {
+			return err
+		}
+		variables = string(data)
+	}
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO jobs (`+jobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		expr.ID, expr.Expression, expr.Status, expr.Result, expr.Error, expr.CreatedAt, expr.Owner, expr.Priority, expr.CallbackURL,
+		variables, expr.BatchID, expr.Ref, expr.Seed)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errExpressionExists
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdateExpression(expr Expression) error {
+	// result_number хранит числовой результат для фильтров и сортировки
+	var number *float64
+	if f, ok := resultNumber(expr); ok {
+		number = &f
+	}
+	_, err := s.db.Exec(`UPDATE jobs SET status = ?, result = ?, error = ?, result_number = ? WHERE id = ?`,
+		expr.Status, expr.Result, expr.Error, number, expr.ID)
+	return err
+}
+
+func (s *SQLiteStore) GetExpression(id string) (Expression, bool, error) {
+	expr, err := scanJob(s.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return Expression{}, false, nil
+	}
+	return expr, err == nil, err
+}
+
+func (s *SQLiteStore) ListExpressions() ([]Expression, error) {
+	rows, err := s.db.Query(`SELECT ` + jobColumns + ` FROM jobs ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Expression
+	for rows.Next() {
+		expr, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expr)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) QueryExpressions(owner *string, q database.ExpressionQuery) ([]Expression, string, error) {
+	where, args := `SELECT `+jobColumns+` FROM jobs WHERE 1 = 1`, []any{}
+	if owner != nil {
+		where += ` AND owner = ?`
+		args = append(args, *owner)
+	}
+	query, args, err := q.SQL(where, args, "created_at", "result_number", "id")
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var result []Expression
+	for rows.Next() {
+		expr, err := scanJob(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		result = append(result, expr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if q.Limit <= 0 || len(result) <= q.Limit {
+		return result, "", nil
+	}
+	result = result[:q.Limit]
+	return result, result[q.Limit-1].cursor(q.Sort).String(), nil
+}
+
+const taskColumns = `id, job_id, node, operation, args, status, lease_id, deadline, result, seq, owner, priority, agent_id, mode`
+
+func scanTask(row interface{ Scan(dest ...any) error }) (TaskRecord, error) {
+	var task TaskRecord
+	var args string
+	var deadline int64
+	err := row.Scan(&task.ID, &task.ExprID, &task.Node, &task.Operation, &args, &task.Status, &task.LeaseID, &deadline, &task.Result, &task.Seq, &task.Owner, &task.Priority, &task.AgentID, &task.Mode)
+	if err != nil {
+		return task, err
+	}
+	if deadline != 0 {
+		task.Deadline = time.Unix(0, deadline)
+	}
+	return task, json.Unmarshal([]byte(args), &task.Args)
+}
+
+func (s *SQLiteStore) SaveTask(task TaskRecord) error {
+	args, err := json.Marshal(task.Args)
+	if err != nil {
+		return err
+	}
+	var deadline int64
+	if !task.Deadline.IsZero() {
+		deadline = task.Deadline.UnixNano()
+	}
+	// seq новой задачи — следующий номер; у существующей он сохраняется
+	_, err = s.db.Exec(`INSERT INTO tasks (`+taskColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM tasks), ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, lease_id = excluded.lease_id,
+			deadline = excluded.deadline, result = excluded.result, agent_id = excluded.agent_id`,
+		task.ID, task.ExprID, task.Node, task.Operation, string(args), task.Status, task.LeaseID, deadline, task.Result,
+		task.Owner, task.Priority, task.AgentID, task.Mode)
+	return err
+}
+
+func (s *SQLiteStore) GetTask(id string) (TaskRecord, bool, error) {
+	task, err := scanTask(s.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return TaskRecord{}, false, nil
+	}
+	return task, err == nil, err
+}
+
+func (s *SQLiteStore) ListTasks(exprID string) ([]TaskRecord, error) {
+	rows, err := s.db.Query(`SELECT `+taskColumns+` FROM tasks WHERE job_id = ? ORDER BY seq`, exprID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TaskRecord
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, task)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) AgentTasks(agentID string) ([]TaskRecord, error) {
+	rows, err := s.db.Query(`SELECT `+taskColumns+` FROM tasks WHERE agent_id = ? AND status = ? ORDER BY seq`,
+		agentID, taskInProgress)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TaskRecord
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, task)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) QueueHeads(now time.Time, operations, modes []string) ([]TaskRecord, error) {
+	filter := ""
+	args := []any{taskQueued, taskInProgress, now.UnixNano()}
+	for column, values := range map[string][]string{"t.operation": operations, "t.mode": modes} {
+		if len(values) == 0 {
+			continue
+		}
+		filter += ` AND ` + column + ` IN (?` + strings.Repeat(`, ?`, len(values)-1) + `)`
+		for _, value := range values {
+			args = append(args, value)
+		}
+	}
+	rows, err := s.db.Query(`SELECT `+taskColumns+` FROM (
+			SELECT t.*, ROW_NUMBER() OVER (PARTITION BY t.owner ORDER BY t.priority DESC, t.seq) AS n
+			FROM tasks t JOIN jobs j ON j.id = t.job_id
+			WHERE j.status IN ('pending', 'in_progress') AND (t.status = ? OR t.status = ? AND t.deadline < ?)`+filter+`
+		) WHERE n = 1 ORDER BY priority DESC, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TaskRecord
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, task)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) ClaimTask(id, agentID string, now time.Time, leaseID string, deadline time.Time) (TaskRecord, bool, error) {
+	res, err := s.db.Exec(`UPDATE tasks SET status = ?, lease_id = ?, deadline = ?, agent_id = ?
+		WHERE id = ? AND (status = ? OR status = ? AND deadline < ?)`,
+		taskInProgress, leaseID, deadline.UnixNano(), agentID, id, taskQueued, taskInProgress, now.UnixNano())
+	if err != nil {
+		return TaskRecord{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TaskRecord{}, false, nil
+	}
+	return s.GetTask(id)
+}
+
+func (s *SQLiteStore) GetIdempotencyKey(key string, now time.Time) (string, bool, error) {
+	var exprID string
+	err := s.db.QueryRow(`SELECT job_id FROM idempotency_keys WHERE key = ? AND expires_at > ?`,
+		key, now.UnixNano()).Scan(&exprID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return exprID, err == nil, err
+}
+
+func (s *SQLiteStore) SaveIdempotencyKey(key, exprID string, now, expires time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.UnixNano()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO idempotency_keys (key, job_id, expires_at) VALUES (?, ?, ?)`,
+		key, exprID, expires.UnixNano()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteExpression(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		`DELETE FROM tasks WHERE job_id = ?`,
+		`DELETE FROM idempotency_keys WHERE job_id = ?`,
+		`DELETE FROM webhook_deliveries WHERE job_id = ?`,
+		`DELETE FROM jobs WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) SaveDelivery(d Delivery) error {
+	_, err := s.db.Exec(`INSERT INTO webhook_deliveries (id, job_id, url, attempt, status_code, error, delivered, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.ExprID, d.URL, d.Attempt, d.StatusCode, d.Error, d.Delivered, d.CreatedAt)
+	return err
+}
+
+func (s *SQLiteStore) ListDeliveries(exprID string) ([]Delivery, error) {
+	rows, err := s.db.Query(`SELECT id, job_id, url, attempt, status_code, error, delivered, created_at
+		FROM webhook_deliveries WHERE job_id = ? ORDER BY id`, exprID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Delivery
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.ExprID, &d.URL, &d.Attempt, &d.StatusCode, &d.Error, &d.Delivered, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) CreateBatch(batch Batch) error {
+	_, err := s.db.Exec(`INSERT INTO batches (id, owner, created_at, size, rejected) VALUES (?, ?, ?, ?, ?)`,
+		batch.ID, batch.Owner, batch.CreatedAt, batch.Size, batch.Rejected)
+	return err
+}
+
+func (s *SQLiteStore) GetBatch(id string) (Batch, bool, error) {
+	var batch Batch
+	err := s.db.QueryRow(`SELECT id, owner, created_at, size, rejected FROM batches WHERE id = ?`, id).
+		Scan(&batch.ID, &batch.Owner, &batch.CreatedAt, &batch.Size, &batch.Rejected)
+	if err == sql.ErrNoRows {
+		return Batch{}, false, nil
+	}
+	return batch, err == nil, err
+}
+
+func (s *SQLiteStore) BatchExpressions(batchID string) ([]Expression, error) {
+	rows, err := s.db.Query(`SELECT `+jobColumns+` FROM jobs WHERE batch_id = ? ORDER BY id`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Expression
+	for rows.Next() {
+		expr, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expr)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,214 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	errInvalidCallback = errors.New("callback_url должен быть абсолютным адресом http или https публичного хоста")
+	errBlockedAddress  = errors.New("Адрес вебхука не публичный")
+)
+
+// WebhookSecret подписывает вебхуки: заголовок X-Signature содержит
+// sha256=<HMAC-SHA256 в hex> от значения X-Webhook-Timestamp, точки и тела.
+// Без секрета вебхуки не подписываются.
+var WebhookSecret string
+
+// WebhookAllowedHosts — хосты, на которые вебхуки отправляются, даже если
+// они внутренние. Остальные адреса должны быть публичными: loopback,
+// частные, link-local (в том числе адрес метаданных облака) и
+// неуказанные адреса отклоняются.
+var WebhookAllowedHosts []string
+
+// UserWebhooks задает адреса вебхуков по умолчанию для выражений
+// пользователей, отправленных без callback_url.
+var UserWebhooks = map[string]string{}
+
+// WebhookAttempts — число попыток доставки вебхука; WebhookBackoff — пауза
+// после первой неудачной попытки, каждая следующая пауза вдвое длиннее.
+var (
+	WebhookAttempts = 5
+	WebhookBackoff  = time.Second
+)
+
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: dialWebhook},
+}
+
+// dialWebhook подключается к получателю вебхука. Адрес проверяется после
+// разрешения имени, поэтому имя, указывающее на внутренний адрес, и
+// перенаправление на него тоже отклоняются.
+func dialWebhook(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if host, _, err := net.SplitHostPort(addr); err != nil || !allowedHost(host) {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !publicIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func allowedHost(host string) bool {
+	return slices.Contains(WebhookAllowedHosts, strings.ToLower(host))
+}
+
+// publicIP сообщает, что адрес доступен из интернета.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// Delivery — попытка доставки вебхука.
+type Delivery struct {
+	ID      string `json:"id"`
+	ExprID  string `json:"expression_id"`
+	URL     string `json:"url"`
+	Attempt int    `json:"attempt"`
+	// StatusCode — код ответа получателя; 0, если ответа не было
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ParseWebhooks разбирает вебхуки пользователей вида
+// "alice=https://a.example/hook,bob=https://b.example/hook".
+func ParseWebhooks(s string) (map[string]string, error) {
+	webhooks := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		user, target, ok := strings.Cut(part, "=")
+		if !ok || !validCallback(strings.TrimSpace(target)) {
+			return nil, fmt.Errorf("Неверный вебхук пользователя %q", part)
+		}
+		webhooks[strings.TrimSpace(user)] = strings.TrimSpace(target)
+	}
+	return webhooks, nil
+}
+
+// validCallback проверяет адрес вебхука: http или https, хост из
+// WebhookAllowedHosts или не внутренний. Имена хостов окончательно
+// проверяются при подключении.
+func validCallback(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if allowedHost(host) {
+		return true
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || publicIP(ip)
+}
+
+// notifyWebhook отправляет в фоне конечное состояние выражения на его
+// callback_url или вебхук пользователя. Вызывается под mu.
+func notifyWebhook(expr Expression) {
+	target := expr.CallbackURL
+	if target == "" {
+		target = UserWebhooks[expr.Owner]
+	}
+	if target == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]Expression{"expression": expr})
+	if err != nil {
+		log.Printf("Ошибка вебхука выражения %s: %v", expr.ID, err)
+		return
+	}
+	go deliver(expr.ID, target, body)
+}
+
+// deliver отправляет вебхук, пока получатель не ответит кодом 2xx или не
+// кончатся попытки, и записывает каждую попытку в журнал доставки.
+func deliver(exprID, target string, body []byte) {
+	backoff := WebhookBackoff
+	for attempt := 1; attempt <= WebhookAttempts; attempt++ {
+		d := Delivery{ID: newID(), ExprID: exprID, URL: target, Attempt: attempt, CreatedAt: now()}
+		code, err := postWebhook(target, body, attempt)
+		d.StatusCode = code
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Delivered = code >= 200 && code < 300
+		}
+		mu.Lock()
+		err = store.SaveDelivery(d)
+		mu.Unlock()
+		if err != nil {
+			log.Printf("Ошибка сохранения доставки вебхука %s: %v", exprID, err)
+		}
+		if d.Delivered {
+			return
+		}
+		if attempt < WebhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postWebhook(target string, body []byte, attempt int) (int, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	// подпись покрывает время отправки, чтобы перехваченную доставку нельзя
+	// было повторить позже
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if WebhookSecret != "" {
+		req.Header.Set("X-Signature", "sha256="+sign(timestamp, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// sign возвращает HMAC-SHA256 строки "<timestamp>.<тело>" с ключом
+// WebhookSecret в hex.
+func sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ListDeliveries возвращает журнал доставки вебхуков выражения в порядке попыток.
+func ListDeliveries(exprID string) ([]Delivery, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return store.ListDeliveries(exprID)
+}
@@ -0,0 +1,148 @@
+package plot
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
+)
+
+// jumpRatio — доля диапазона по y, начиная с которой скачок между соседними
+// точками проверяется на разрыв (например, 1/x около нуля).
+const jumpRatio = 0.5
+
+const margin = 40
+
+// WriteCSV записывает точки в формате x,y,error.
+func WriteCSV(w io.Writer, points []calculator.Point) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"x", "y", "error"}); err != nil {
+		return err
+	}
+	for _, p := range points {
+		record := []string{formatFloat(p.X), "", ""}
+		if p.Err != nil {
+			record[2] = p.Err.Error()
+		} else {
+			record[1] = formatFloat(p.Y)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Segments разбивает точки на непрерывные участки. Участок обрывается на
+// точке с ошибкой и на разрыве: скачке больше jumpRatio от диапазона
+// значений, направление которого противоположно соседним шагам.
+func Segments(points []calculator.Point) [][]calculator.Point {
+	minY, maxY, ok := yRange(points)
+	if !ok {
+		return nil
+	}
+	threshold := jumpRatio * (maxY - minY)
+
+	var segments [][]calculator.Point
+	var current []calculator.Point
+	for i, p := range points {
+		if p.Err != nil {
+			if len(current) > 0 {
+				segments = append(segments, current)
+			}
+			current = nil
+			continue
+		}
+		if n := len(current); n > 0 && threshold > 0 {
+			dy := p.Y - current[n-1].Y
+			reversed := n > 1 && dy*(current[n-1].Y-current[n-2].Y) < 0 ||
+				i+1 < len(points) && points[i+1].Err == nil && dy*(points[i+1].Y-p.Y) < 0
+			if math.Abs(dy) > threshold && reversed {
+				segments = append(segments, current)
+				current = nil
+			}
+		}
+		current = append(current, p)
+	}
+	if len(current) > 0 {
+		segments = append(segments, current)
+	}
+	return segments
+}
+
+// SVG рисует линейный график точек размером width x height.
+func SVG(points []calculator.Point, width, height int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", width, height, width, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+
+	minY, maxY, ok := yRange(points)
+	if !ok || len(points) == 0 {
+		b.WriteString("</svg>\n")
+		return b.Bytes()
+	}
+	if minY == maxY {
+		minY, maxY = minY-1, maxY+1
+	}
+	minX, maxX := points[0].X, points[len(points)-1].X
+	if minX == maxX {
+		minX, maxX = minX-1, maxX+1
+	}
+	sx := func(x float64) float64 {
+		return margin + (x-minX)/(maxX-minX)*float64(width-2*margin)
+	}
+	sy := func(y float64) float64 {
+		return float64(height-margin) - (y-minY)/(maxY-minY)*float64(height-2*margin)
+	}
+
+	// оси рисуются, если ноль попадает в диапазон
+	if minY <= 0 && maxY >= 0 {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%s" x2="%d" y2="%s" stroke="gray"/>`+"\n", margin, formatCoord(sy(0)), width-margin, formatCoord(sy(0)))
+	}
+	if minX <= 0 && maxX >= 0 {
+		fmt.Fprintf(&b, `<line x1="%s" y1="%d" x2="%s" y2="%d" stroke="gray"/>`+"\n", formatCoord(sx(0)), margin, formatCoord(sx(0)), height-margin)
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="12">%s</text>`+"\n", margin, margin-8, formatFloat(maxY))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="12">%s</text>`+"\n", margin, height-margin+16, formatFloat(minY))
+
+	for _, segment := range Segments(points) {
+		if len(segment) == 1 {
+			fmt.Fprintf(&b, `<circle cx="%s" cy="%s" r="2" fill="steelblue"/>`+"\n", formatCoord(sx(segment[0].X)), formatCoord(sy(segment[0].Y)))
+			continue
+		}
+		b.WriteString(`<polyline fill="none" stroke="steelblue" stroke-width="2" points="`)
+		for i, p := range segment {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(formatCoord(sx(p.X)) + "," + formatCoord(sy(p.Y)))
+		}
+		b.WriteString(`"/>` + "\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+func yRange(points []calculator.Point) (float64, float64, bool) {
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		if p.Err == nil {
+			minY = math.Min(minY, p.Y)
+			maxY = math.Max(maxY, p.Y)
+		}
+	}
+	return minY, maxY, minY <= maxY
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatCoord(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
@@ -0,0 +1,59 @@
+package plot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/terlyne/go-calculator/pkg/calculator"
+)
+
+func TestSegments(t *testing.T) {
+	points, err := calculator.Table("1/x", "x", -2, 2, 0.5)
+	if err != nil {
+		t.Fatalf("Table returned error: %v", err)
+	}
+	segments := Segments(points)
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments around x=0, got %d", len(segments))
+	}
+	for _, segment := range segments {
+		for _, p := range segment {
+			if p.X == 0 {
+				t.Errorf("point x=0 must not be drawn")
+			}
+		}
+	}
+
+	points, _ = calculator.Table("1/x", "x", -1.5, 1.5, 0.3)
+	if segments := Segments(points); len(segments) != 2 {
+		t.Errorf("expected 1/x to break between -0.3 and 0.3, got %d segments", len(segments))
+	}
+
+	points, _ = calculator.Table("x * x", "x", -1, 1, 0.25)
+	if segments := Segments(points); len(segments) != 1 {
+		t.Errorf("continuous function must be drawn as one segment, got %d", len(segments))
+	}
+}
+
+func TestOutput(t *testing.T) {
+	points := []calculator.Point{{X: 0, Y: 1}, {X: 1, Y: 2}, {X: 2, Err: errEmpty{}}}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, points); err != nil {
+		t.Fatalf("WriteCSV returned error: %v", err)
+	}
+	expected := "x,y,error\n0,1,\n1,2,\n2,,undefined\n"
+	if buf.String() != expected {
+		t.Errorf("WriteCSV = %q, expected %q", buf.String(), expected)
+	}
+
+	svg := string(SVG(points, 400, 300))
+	if !strings.HasPrefix(svg, "<svg") || strings.Count(svg, "<polyline") != 1 {
+		t.Errorf("unexpected SVG: %s", svg)
+	}
+}
+
+type errEmpty struct{}
+
+func (errEmpty) Error() string { return "undefined" }